@@ -0,0 +1,130 @@
+// Copyright 2020 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/j-keck/arping"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+)
+
+// announceAddresses sends a gratuitous arp for each ipv4 address and an
+// unsolicited neighbor advertisement for each ipv6 address of the given
+// ips, so that the neighbors refresh the entries they had before the
+// interface changed master. Ipv6 addresses still tentative are skipped,
+// as they must not be advertised until DAD completes.
+func announceAddresses(intf netlink.Link, ips []*types100.IPConfig) error {
+	tentative, err := tentativeAddresses(intf)
+	if err != nil {
+		return err
+	}
+
+	for _, ip := range ips {
+		addr := ip.Address.IP
+		if addr.To4() != nil {
+			err = arping.GratuitousArpOverIfaceByName(addr.To4(), intf.Attrs().Name)
+			if err != nil {
+				return fmt.Errorf("failed to send gratuitous arp for %s on %s: %w", addr, intf.Attrs().Name, err)
+			}
+			continue
+		}
+		if tentative[addr.String()] {
+			continue
+		}
+		err = sendUnsolicitedNA(intf, addr)
+		if err != nil {
+			return fmt.Errorf("failed to send neighbor advertisement for %s on %s: %w", addr, intf.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// tentativeAddresses returns the ipv6 addresses of the interface that did
+// not complete DAD yet.
+func tentativeAddresses(intf netlink.Link) (map[string]bool, error) {
+	addrs, err := nlh.AddrList(intf, netlink.FAMILY_V6)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing addresses of %s: %w", intf.Attrs().Name, err)
+	}
+	res := make(map[string]bool)
+	for _, a := range addrs {
+		if a.Flags&(unix.IFA_F_TENTATIVE|unix.IFA_F_DADFAILED) != 0 {
+			res[a.IP.String()] = true
+		}
+	}
+	return res, nil
+}
+
+// sendUnsolicitedNA sends an unsolicited neighbor advertisement for the
+// given address to the all-nodes multicast group. The socket is bound to the
+// interface, so that the packet goes out of it in the VRF it belongs to.
+func sendUnsolicitedNA(intf netlink.Link, addr net.IP) error {
+	name := intf.Attrs().Name
+	lc := net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var bindErr error
+			err := c.Control(func(fd uintptr) {
+				bindErr = unix.BindToDevice(int(fd), name)
+			})
+			if err != nil {
+				return err
+			}
+			return bindErr
+		},
+	}
+	conn, err := lc.ListenPacket(context.Background(), "ip6:ipv6-icmp", "::")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	pc := ipv6.NewPacketConn(conn)
+	// Neighbor discovery packets are dropped unless their hop limit is 255.
+	if err := pc.SetMulticastHopLimit(255); err != nil {
+		return err
+	}
+
+	// Override flag set, followed by the target address and, for ethernet
+	// interfaces, the target link-layer address option.
+	body := make([]byte, 0, 4+net.IPv6len+8)
+	body = append(body, 0x20, 0, 0, 0)
+	body = append(body, addr.To16()...)
+	if mac := intf.Attrs().HardwareAddr; len(mac) == 6 {
+		body = append(body, 2, 1)
+		body = append(body, mac...)
+	}
+
+	msg := icmp.Message{
+		Type: ipv6.ICMPTypeNeighborAdvertisement,
+		Body: &icmp.RawBody{Data: body},
+	}
+	// The kernel fills the checksum of icmpv6 raw sockets.
+	data, err := msg.Marshal(nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = pc.WriteTo(data, nil, &net.IPAddr{IP: net.IPv6linklocalallnodes, Zone: name})
+	return err
+}
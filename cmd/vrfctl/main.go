@@ -0,0 +1,71 @@
+// Copyright 2020 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// vrfctl shows the VRFs of a sandbox: their routing table, state, member
+// interfaces with their addresses, the routes of their table and the ip
+// rules that involve them.
+//
+// Usage:
+//
+//	vrfctl -netns /var/run/netns/sandbox [-vrf name] [-o table|json]
+//	vrfctl -pid 1234 [-vrf name] [-o table|json]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+func main() {
+	netns := flag.String("netns", "", "path of the netns to inspect")
+	pid := flag.Int("pid", 0, "pid of a process in the netns to inspect")
+	vrfName := flag.String("vrf", "", "name of the only VRF to show")
+	output := flag.String("o", "table", "output format, table or json")
+	flag.Parse()
+
+	if err := run(*netns, *pid, *vrfName, *output); err != nil {
+		fmt.Fprintf(os.Stderr, "vrfctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(netns string, pid int, vrfName, output string) error {
+	if (netns == "") == (pid == 0) {
+		return fmt.Errorf("exactly one of -netns and -pid is expected")
+	}
+	if pid != 0 {
+		netns = fmt.Sprintf("/proc/%d/ns/net", pid)
+	}
+	if output != "table" && output != "json" {
+		return fmt.Errorf("invalid output format %s", output)
+	}
+
+	var r *report
+	err := ns.WithNetNSPath(netns, func(_ ns.NetNS) error {
+		var err error
+		r, err = collect(vrfName)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if output == "json" {
+		return printJSON(os.Stdout, r)
+	}
+	return printTable(os.Stdout, r)
+}
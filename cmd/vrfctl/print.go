@@ -0,0 +1,78 @@
+// Copyright 2020 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+func printJSON(w io.Writer, r *report) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	return enc.Encode(r)
+}
+
+// printTable prints a summary of the VRFs, then the members and the routes
+// of each VRF, then the rules.
+func printTable(w io.Writer, r *report) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "VRF\tTABLE\tSTATE\tMEMBERS")
+	for _, v := range r.VRFs {
+		names := make([]string, 0, len(v.Members))
+		for _, m := range v.Members {
+			names = append(names, m.Name)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", v.Name, v.Table, state(v.Up), orNone(strings.Join(names, ",")))
+	}
+
+	for _, v := range r.VRFs {
+		fmt.Fprintf(tw, "\nMembers of %s:\n", v.Name)
+		fmt.Fprintln(tw, "INTERFACE\tSTATE\tADDRESSES")
+		for _, m := range v.Members {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", m.Name, state(m.Up), orNone(strings.Join(m.Addresses, ",")))
+		}
+
+		fmt.Fprintf(tw, "\nRoutes of %s (table %d):\n", v.Name, v.Table)
+		for _, route := range v.Routes {
+			fmt.Fprintln(tw, route)
+		}
+	}
+
+	fmt.Fprintln(tw, "\nRules:")
+	fmt.Fprintln(tw, "FAMILY\tPREF\tRULE")
+	for _, rule := range r.Rules {
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", rule.Family, rule.Priority, rule.Rule)
+	}
+	return tw.Flush()
+}
+
+func state(up bool) string {
+	if up {
+		return "up"
+	}
+	return "down"
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
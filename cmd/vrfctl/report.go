@@ -0,0 +1,252 @@
+// Copyright 2020 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	libvrf "github.com/fedepaol/vrfcni/pkg/vrf"
+)
+
+// report is what vrfctl shows about a netns.
+type report struct {
+	VRFs  []vrfReport  `json:"vrfs"`
+	Rules []ruleReport `json:"rules"`
+}
+
+type vrfReport struct {
+	Name    string         `json:"name"`
+	Table   uint32         `json:"table"`
+	Up      bool           `json:"up"`
+	Members []memberReport `json:"members"`
+	Routes  []string       `json:"routes"`
+}
+
+type memberReport struct {
+	Name      string   `json:"name"`
+	Up        bool     `json:"up"`
+	Addresses []string `json:"addresses"`
+}
+
+type ruleReport struct {
+	Family   string `json:"family"`
+	Priority int    `json:"priority"`
+	Rule     string `json:"rule"`
+}
+
+var familyNames = map[int]string{
+	netlink.FAMILY_V4: "ipv4",
+	netlink.FAMILY_V6: "ipv6",
+}
+
+// collect builds the report of the current netns. When vrfName is set,
+// only that VRF and its rules are reported.
+func collect(vrfName string) (*report, error) {
+	h := libvrf.Kernel()
+	links, err := libvrf.TakeSnapshot(h)
+	if err != nil {
+		return nil, err
+	}
+
+	vrfs := links.VRFs()
+	if vrfName != "" {
+		vrf, err := libvrf.FindVRF(h, vrfName)
+		if libvrf.IsLinkNotFound(err) {
+			return nil, fmt.Errorf("VRF %s not found", vrfName)
+		}
+		if err != nil {
+			return nil, err
+		}
+		vrfs = []*netlink.Vrf{vrf}
+	}
+
+	res := &report{
+		VRFs:  make([]vrfReport, 0, len(vrfs)),
+		Rules: make([]ruleReport, 0),
+	}
+	tables := make(map[int]string, len(vrfs))
+	for _, vrf := range vrfs {
+		r, err := collectVRF(h, vrf, links)
+		if err != nil {
+			return nil, err
+		}
+		res.VRFs = append(res.VRFs, *r)
+		tables[int(vrf.Table)] = vrf.Name
+	}
+
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rules, err := collectRules(h, family, tables)
+		if err != nil {
+			return nil, err
+		}
+		res.Rules = append(res.Rules, rules...)
+	}
+	return res, nil
+}
+
+func collectVRF(h libvrf.Netlink, vrf *netlink.Vrf, links *libvrf.Snapshot) (*vrfReport, error) {
+	res := &vrfReport{
+		Name:    vrf.Name,
+		Table:   vrf.Table,
+		Up:      vrf.Flags&net.FlagUp != 0,
+		Members: make([]memberReport, 0),
+		Routes:  make([]string, 0),
+	}
+
+	members := append([]netlink.Link(nil), links.AssignedInterfaces(vrf)...)
+	sort.Slice(members, func(i, j int) bool { return members[i].Attrs().Name < members[j].Attrs().Name })
+	for _, l := range members {
+		addrs, err := h.AddrList(l, netlink.FAMILY_ALL)
+		if err != nil {
+			return nil, fmt.Errorf("failed listing addresses of %s: %v", l.Attrs().Name, err)
+		}
+		m := memberReport{
+			Name:      l.Attrs().Name,
+			Up:        l.Attrs().Flags&net.FlagUp != 0,
+			Addresses: make([]string, 0, len(addrs)),
+		}
+		for _, a := range addrs {
+			m.Addresses = append(m.Addresses, a.IPNet.String())
+		}
+		res.Members = append(res.Members, m)
+	}
+
+	routes, err := h.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: int(vrf.Table)}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing routes of table %d: %v", vrf.Table, err)
+	}
+	for _, r := range routes {
+		res.Routes = append(res.Routes, formatRoute(r, links))
+	}
+	return res, nil
+}
+
+// collectRules returns the l3mdev rules, the local table rules and the
+// rules pointing to one of the given tables.
+func collectRules(h libvrf.Netlink, family int, tables map[int]string) ([]ruleReport, error) {
+	res := make([]ruleReport, 0)
+	l3mdev, err := h.L3mdevRulePriorities(family)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range l3mdev {
+		res = append(res, ruleReport{Family: familyNames[family], Priority: p, Rule: "l3mdev"})
+	}
+
+	rules, err := h.RuleList(family)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing rules: %v", err)
+	}
+	for _, r := range rules {
+		if _, ok := tables[r.Table]; !ok && r.Table != unix.RT_TABLE_LOCAL {
+			continue
+		}
+		priority := r.Priority
+		// The kernel does not report the preference when it's 0.
+		if priority < 0 {
+			priority = 0
+		}
+		res = append(res, ruleReport{Family: familyNames[family], Priority: priority, Rule: formatRule(r, tables)})
+	}
+
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Priority < res[j].Priority })
+	return res, nil
+}
+
+// formatRoute renders the route the way ip route does.
+func formatRoute(r netlink.Route, links *libvrf.Snapshot) string {
+	parts := make([]string, 0)
+	if r.Type != unix.RTN_UNICAST {
+		parts = append(parts, routeTypeName(r.Type))
+	}
+	if r.Dst == nil {
+		parts = append(parts, "default")
+	} else {
+		parts = append(parts, r.Dst.String())
+	}
+	if r.Gw != nil {
+		parts = append(parts, "via", r.Gw.String())
+	}
+	if r.LinkIndex != 0 {
+		dev := fmt.Sprintf("if%d", r.LinkIndex)
+		if l, ok := links.LinkByIndex(r.LinkIndex); ok {
+			dev = l.Attrs().Name
+		}
+		parts = append(parts, "dev", dev)
+	}
+	if r.Src != nil {
+		parts = append(parts, "src", r.Src.String())
+	}
+	if r.Priority != 0 {
+		parts = append(parts, "metric", fmt.Sprint(r.Priority))
+	}
+	return strings.Join(parts, " ")
+}
+
+func routeTypeName(t int) string {
+	switch t {
+	case unix.RTN_LOCAL:
+		return "local"
+	case unix.RTN_BROADCAST:
+		return "broadcast"
+	case unix.RTN_MULTICAST:
+		return "multicast"
+	case unix.RTN_UNREACHABLE:
+		return "unreachable"
+	case unix.RTN_PROHIBIT:
+		return "prohibit"
+	case unix.RTN_BLACKHOLE:
+		return "blackhole"
+	}
+	return fmt.Sprintf("type%d", t)
+}
+
+// formatRule renders the rule the way ip rule does, naming the tables
+// after their VRF.
+func formatRule(r netlink.Rule, tables map[int]string) string {
+	parts := make([]string, 0)
+	if r.Src != nil {
+		parts = append(parts, "from", r.Src.String())
+	} else {
+		parts = append(parts, "from", "all")
+	}
+	if r.Dst != nil {
+		parts = append(parts, "to", r.Dst.String())
+	}
+	if r.Mark > 0 {
+		parts = append(parts, "fwmark", fmt.Sprintf("%#x", r.Mark))
+	}
+	if r.IifName != "" {
+		parts = append(parts, "iif", r.IifName)
+	}
+	if r.OifName != "" {
+		parts = append(parts, "oif", r.OifName)
+	}
+	switch {
+	case r.Table == unix.RT_TABLE_LOCAL:
+		parts = append(parts, "lookup", "local")
+	case tables[r.Table] != "":
+		parts = append(parts, "lookup", fmt.Sprintf("%d (%s)", r.Table, tables[r.Table]))
+	default:
+		parts = append(parts, "lookup", fmt.Sprint(r.Table))
+	}
+	return strings.Join(parts, " ")
+}
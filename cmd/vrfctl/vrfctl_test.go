@@ -0,0 +1,101 @@
+// Copyright 2020 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("vrfctl", func() {
+	r := &report{
+		VRFs: []vrfReport{{
+			Name:  "vrf0",
+			Table: 1001,
+			Up:    true,
+			Members: []memberReport{
+				{Name: "eth0", Up: true, Addresses: []string{"10.0.0.2/24", "2001:db8::2/64"}},
+			},
+			Routes: []string{"default via 10.0.0.1 dev eth0"},
+		}},
+		Rules: []ruleReport{
+			{Family: "ipv4", Priority: 1000, Rule: "l3mdev"},
+			{Family: "ipv4", Priority: 32765, Rule: "from all lookup local"},
+		},
+	}
+
+	It("prints tables", func() {
+		out := &bytes.Buffer{}
+		Expect(printTable(out, r)).To(Succeed())
+		Expect(out.String()).To(MatchRegexp(`vrf0\s+1001\s+up\s+eth0`))
+		Expect(out.String()).To(MatchRegexp(`eth0\s+up\s+10.0.0.2/24,2001:db8::2/64`))
+		Expect(out.String()).To(ContainSubstring("Routes of vrf0 (table 1001):\ndefault via 10.0.0.1 dev eth0"))
+		Expect(out.String()).To(MatchRegexp(`ipv4\s+1000\s+l3mdev`))
+	})
+
+	It("prints json", func() {
+		out := &bytes.Buffer{}
+		Expect(printJSON(out, r)).To(Succeed())
+		parsed := &report{}
+		Expect(json.Unmarshal(out.Bytes(), parsed)).To(Succeed())
+		Expect(parsed).To(Equal(r))
+	})
+
+	It("rejects invalid arguments", func() {
+		Expect(run("", 0, "", "table")).To(MatchError(ContainSubstring("exactly one of -netns and -pid")))
+		Expect(run("/var/run/netns/test", 1, "", "table")).To(MatchError(ContainSubstring("exactly one of -netns and -pid")))
+		Expect(run("/var/run/netns/test", 0, "", "yaml")).To(MatchError(ContainSubstring("invalid output format yaml")))
+	})
+
+	DescribeTable("formats the rules",
+		func(rule func() netlink.Rule, expected string) {
+			Expect(formatRule(rule(), map[int]string{1001: "vrf0"})).To(Equal(expected))
+		},
+		Entry("the local rule", func() netlink.Rule {
+			r := *netlink.NewRule()
+			r.Table = unix.RT_TABLE_LOCAL
+			return r
+		}, "from all lookup local"),
+		Entry("a rule to a vrf table", func() netlink.Rule {
+			r := *netlink.NewRule()
+			_, src, _ := net.ParseCIDR("10.0.0.0/24")
+			r.Src = src
+			r.Mark = 1
+			r.Table = 1001
+			return r
+		}, "from 10.0.0.0/24 fwmark 0x1 lookup 1001 (vrf0)"),
+	)
+
+	DescribeTable("formats the routes",
+		func(route func() netlink.Route, expected string) {
+			Expect(formatRoute(route(), nil)).To(Equal(expected))
+		},
+		Entry("an unreachable default route", func() netlink.Route {
+			return netlink.Route{Type: unix.RTN_UNREACHABLE, Priority: 4278198272}
+		}, "unreachable default metric 4278198272"),
+		Entry("a route via a gateway", func() netlink.Route {
+			_, dst, _ := net.ParseCIDR("192.168.0.0/16")
+			return netlink.Route{Type: unix.RTN_UNICAST, Dst: dst, Gw: net.ParseIP("10.0.0.1")}
+		}, "192.168.0.0/16 via 10.0.0.1"),
+	)
+})
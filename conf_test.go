@@ -0,0 +1,221 @@
+// Copyright 2020 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+// These tests only parse configurations and write files, so they do not
+// need root.
+var _ = Describe("vrf configuration", func() {
+	const (
+		IF0Name  = "dummy0"
+		VRF0Name = "vrf0"
+	)
+
+	It("rejects unsupported sysctls", func() {
+		conf := []byte(fmt.Sprintf(`{
+	"name": "test",
+	"type": "vrf",
+	"cniVersion": "1.0.0",
+	"vrfName": "%s",
+	"sysctls": {
+		"net.ipv4.ip_forward": "1"
+	}
+}`, VRF0Name))
+		_, _, err := parseConf(conf)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("sysctl net.ipv4.ip_forward is not supported"))
+	})
+
+	DescribeTable("rejects invalid VRF names",
+		func(name, expectedError string) {
+			conf := []byte(fmt.Sprintf(`{
+	"name": "test",
+	"type": "vrf",
+	"cniVersion": "1.0.0",
+	"vrfName": %q
+}`, name))
+			_, _, err := parseConf(conf)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(expectedError))
+		},
+		Entry("an empty name", "", "configuration is expected to have a valid vrf name"),
+		Entry("a name too long", "averyveryverylongvrf", "longer than 15 characters"),
+		Entry("a name with a slash", "vrf/0", "must not contain '/'"),
+		Entry("a name with a space", "vrf 0", "must not contain whitespaces"),
+		Entry("a name with a colon", "vrf:0", "must not contain ':'"),
+		Entry("a dot", ".", "invalid vrf name"),
+	)
+
+	It("shortens long VRF names when configured to", func() {
+		shortenConf := func(name string) []byte {
+			return confFor("test", IF0Name, name, "10.0.0.2/24", `"shortenVRFName": true,`)
+		}
+
+		conf, _, err := parseConf(shortenConf("averyveryverylongvrf"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.VRFName).To(HaveLen(15))
+		Expect(conf.VRFName).To(HavePrefix("averyve"))
+
+		other, _, err := parseConf(shortenConf("averyveryverylongvrf1"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(other.VRFName).NotTo(Equal(conf.VRFName))
+
+		short, _, err := parseConf(shortenConf(VRF0Name))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(short.VRFName).To(Equal(VRF0Name))
+	})
+
+	DescribeTable("rejects invalid tables",
+		func(tables, expectedError string) {
+			conf := []byte(fmt.Sprintf(`{
+	"name": "test",
+	"type": "vrf",
+	"cniVersion": "1.0.0",
+	"vrfName": "%s",
+	%s
+}`, VRF0Name, tables))
+			_, _, err := parseConf(conf)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(expectedError))
+		},
+		Entry("the default table", `"table": 253`, "routing table 253 is reserved"),
+		Entry("the main table", `"table": 254`, "routing table 254 is reserved"),
+		Entry("the local table", `"table": 255`, "routing table 255 is reserved"),
+		Entry("a denied table", `"table": 1001, "denyTables": [1001]`, "routing table 1001 is reserved"),
+		Entry("an empty range", `"tableRange": {"min": 2000, "max": 1000}`, "invalid tableRange 2000-1000"),
+		Entry("a range starting from 0", `"tableRange": {"min": 0, "max": 1000}`, "invalid tableRange 0-1000"),
+		Entry("an unknown allocation mode", `"tableAllocation": "random"`, "invalid tableAllocation random"),
+	)
+
+	It("rotates the log file once it is too big", func() {
+		logDir, err := os.MkdirTemp("", "vrf-cni")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(logDir)
+		logFile := filepath.Join(logDir, "vrf.log")
+
+		Expect(os.WriteFile(logFile, nil, 0600)).To(Succeed())
+		Expect(os.Truncate(logFile, logMaxSize)).To(Succeed())
+
+		f, err := openLogFile(logFile)
+		Expect(err).NotTo(HaveOccurred())
+		defer f.Close()
+
+		st, err := f.Stat()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(st.Size()).To(BeZero())
+		st, err = os.Stat(logFile + ".1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(st.Size()).To(Equal(int64(logMaxSize)))
+	})
+
+	It("rotates the log file only once when opened concurrently", func() {
+		logDir, err := os.MkdirTemp("", "vrf-cni")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(logDir)
+		logFile := filepath.Join(logDir, "vrf.log")
+
+		Expect(os.WriteFile(logFile, nil, 0600)).To(Succeed())
+		Expect(os.Truncate(logFile, logMaxSize)).To(Succeed())
+
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				<-start
+				f, err := openLogFile(logFile)
+				Expect(err).NotTo(HaveOccurred())
+				f.Close()
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		st, err := os.Stat(logFile + ".1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(st.Size()).To(Equal(int64(logMaxSize)))
+		_, err = os.Stat(logFile + ".2")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+})
+
+// testDataDir is the data dir of the configurations built by confFor, a
+// temporary directory for each spec so that the attachments recorded by
+// ADD do not end up in the one of the host.
+var testDataDir string
+
+var _ = BeforeEach(func() {
+	var err error
+	testDataDir, err = os.MkdirTemp("", "vrf-cni")
+	Expect(err).NotTo(HaveOccurred())
+})
+
+var _ = AfterEach(func() {
+	Expect(os.RemoveAll(testDataDir)).To(Succeed())
+})
+
+// confFor returns the configuration of the given network, with the extra
+// fields, if any, followed by a comma.
+func confFor(name, intf, vrf, ip, extra string) []byte {
+	return confVersionFor("0.3.1", name, intf, vrf, extra, ip)
+}
+
+// confWithTableFor is confFor with the given routing table.
+func confWithTableFor(name, intf, vrf, ip string, tableID int, extra string) []byte {
+	return confFor(name, intf, vrf, ip, fmt.Sprintf(`"table": %d,`, tableID)+extra)
+}
+
+// confVersionFor is confFor for the given CNI version, with a previous result
+// assigning the given addresses, if any, to the interface. IPv4 addresses get
+// 10.0.0.1 as their gateway.
+func confVersionFor(version, name, intf, vrf, extra string, ips ...string) []byte {
+	prevIPs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		if strings.Contains(ip, ":") {
+			prevIPs = append(prevIPs, fmt.Sprintf(`{"version": "6", "address": "%s", "interface": 0}`, ip))
+			continue
+		}
+		prevIPs = append(prevIPs, fmt.Sprintf(`{"version": "4", "address": "%s", "gateway": "10.0.0.1", "interface": 0}`, ip))
+	}
+	conf := fmt.Sprintf(`{
+		"name": "%s",
+		"type": "vrf",
+		"cniVersion": "%s",
+		"vrfName": "%s",
+		"dataDir": %q,
+		%s
+		"prevResult": {
+			"cniVersion": "%s",
+			"interfaces": [
+				{"name": "%s", "sandbox":"netns"}
+			],
+			"ips": [%s]
+		}
+	}`, name, version, vrf, testDataDir, extra, version, intf, strings.Join(prevIPs, ", "))
+	return []byte(conf)
+}
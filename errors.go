@@ -0,0 +1,132 @@
+// Copyright 2020 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"golang.org/x/sys/unix"
+
+	libvrf "github.com/fedepaol/vrfcni/pkg/vrf"
+)
+
+// Plugin specific error codes. The spec reserves the codes from 100 on
+// for them.
+const (
+	// errTableConflict is returned when the routing table of the VRF
+	// does not match the configured one, or is used by another VRF.
+	errTableConflict uint = 100
+	// errInterfaceHasMaster is returned when the interface is already
+	// enslaved to another master.
+	errInterfaceHasMaster uint = 101
+	// errVRFNotFound is returned by CHECK when the VRF does not exist.
+	errVRFNotFound uint = 102
+	// errNetlink is returned when the kernel fails a netlink request.
+	// Unlike the other codes, it points to a fault of the node rather
+	// than to a misconfiguration.
+	errNetlink uint = 103
+	// errNoTableAvailable is returned when all the routing tables the
+	// configuration allows are taken.
+	errNoTableAvailable uint = 104
+	// errInterfaceNotFound is returned when the interface to add to the
+	// VRF does not exist.
+	errInterfaceNotFound uint = 105
+	// errDrift is returned by CHECK when the VRF, the interface or the
+	// routes differ from what ADD configured.
+	errDrift uint = 106
+)
+
+// newError returns a CNI error with the given code, details and formatted
+// message. The details carry the cause of the failure, such as the errno
+// or the link or routing table it is about.
+func newError(code uint, details, format string, a ...interface{}) *types.Error {
+	return types.NewError(code, fmt.Sprintf(format, a...), details)
+}
+
+// configError returns an invalid network configuration error.
+func configError(format string, a ...interface{}) *types.Error {
+	return newError(types.ErrInvalidNetworkConfig, "", format, a...)
+}
+
+// driftError returns the error CHECK reports when the given link or route
+// is not as ADD configured it.
+func driftError(details, format string, a ...interface{}) *types.Error {
+	return newError(errDrift, details, format, a...)
+}
+
+// causeOf returns the errno behind the error, if any, or the error itself,
+// to be used as details.
+func causeOf(err error) string {
+	var errno unix.Errno
+	if errors.As(err, &errno) {
+		return fmt.Sprintf("%s: %v", unix.ErrnoName(errno), errno)
+	}
+	return err.Error()
+}
+
+// netlinkCode returns errNetlink for the errors carrying an errno from
+// the kernel, and ErrInternal for the others.
+func netlinkCode(err error) uint {
+	var errno unix.Errno
+	if errors.As(err, &errno) {
+		return errNetlink
+	}
+	return types.ErrInternal
+}
+
+// wrapError prefixes the message of the error with the given context. CNI
+// errors, also when wrapped, keep their code, the errors of the vrf package
+// and a missing netns get the matching code and any other error gets the
+// given code. The details are the subject of the errors of the vrf package
+// and the errno behind the others, if any.
+func wrapError(err error, code uint, context string) *types.Error {
+	var e *types.Error
+	if errors.As(err, &e) {
+		msg := e.Msg
+		if err != error(e) {
+			msg = err.Error()
+		}
+		return types.NewError(e.Code, fmt.Sprintf("%s: %s", context, msg), e.Details)
+	}
+	switch {
+	case errors.Is(err, libvrf.ErrTableConflict):
+		code = errTableConflict
+	case errors.Is(err, libvrf.ErrHasMaster):
+		code = errInterfaceHasMaster
+	case errors.Is(err, libvrf.ErrReservedTable):
+		code = types.ErrInvalidNetworkConfig
+	case errors.Is(err, libvrf.ErrNoTableAvailable):
+		code = errNoTableAvailable
+	case errors.Is(err, libvrf.ErrInterfaceNotFound):
+		code = errInterfaceNotFound
+	}
+	if _, ok := err.(ns.NSPathNotExistErr); ok {
+		code = types.ErrInvalidNetNS
+	}
+
+	details := ""
+	var vrfErr *libvrf.Error
+	var errno unix.Errno
+	switch {
+	case errors.As(err, &vrfErr):
+		details = vrfErr.Subject
+	case errors.As(err, &errno):
+		details = causeOf(errno)
+	}
+	return types.NewError(code, fmt.Sprintf("%s: %v", context, err), details)
+}
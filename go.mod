@@ -1,14 +1,26 @@
 module github.com/fedepaol/vrfcni
 
-go 1.14
+go 1.21
 
 require (
-	github.com/containernetworking/cni v0.8.0
-	github.com/containernetworking/plugins v0.8.6
+	github.com/containernetworking/cni v1.2.3
+	github.com/containernetworking/plugins v1.5.1
 	github.com/j-keck/arping v1.0.1
-	github.com/onsi/ginkgo v0.0.0-20151202141238-7f8ab55aaf3b
-	github.com/onsi/gomega v0.0.0-20151007035656-2152b45fa28a
-	github.com/vishvananda/netlink v1.1.0
-	github.com/vishvananda/netns v0.0.0-20200728191858-db3c7e526aae // indirect
-	golang.org/x/sys v0.0.0-20200728102440-3e129f6d46b1 // indirect
+	github.com/onsi/ginkgo v1.16.5
+	github.com/onsi/gomega v1.33.1
+	github.com/vishvananda/netlink v1.2.1-beta.2
+	golang.org/x/net v0.25.0
+	golang.org/x/sys v0.21.0
+)
+
+require (
+	github.com/fsnotify/fsnotify v1.6.0 // indirect
+	github.com/google/go-cmp v0.6.0 // indirect
+	github.com/kr/pretty v0.3.1 // indirect
+	github.com/nxadm/tail v1.4.8 // indirect
+	github.com/vishvananda/netns v0.0.4 // indirect
+	golang.org/x/text v0.15.0 // indirect
+	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
+	gopkg.in/tomb.v1 v1.0.0-20141024135613-dd632973f1e7 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
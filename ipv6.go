@@ -0,0 +1,57 @@
+// Copyright 2020 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// dadPollInterval is how often the addresses are checked while waiting for DAD.
+const dadPollInterval = 100 * time.Millisecond
+
+// waitForDAD waits until none of the ipv6 addresses of the interface are
+// tentative anymore, failing if any of them is a duplicate or if the timeout
+// expires.
+func waitForDAD(intf netlink.Link, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		addresses, err := nlh.AddrList(intf, netlink.FAMILY_V6)
+		if err != nil {
+			return fmt.Errorf("failed getting ipv6 addresses for %s: %w", intf.Attrs().Name, err)
+		}
+
+		var tentative *netlink.Addr
+		for i, a := range addresses {
+			if a.Flags&unix.IFA_F_DADFAILED != 0 {
+				return configError("duplicate address %s detected on %s", a.IPNet, intf.Attrs().Name)
+			}
+			if a.Flags&unix.IFA_F_TENTATIVE != 0 {
+				tentative = &addresses[i]
+			}
+		}
+		if tentative == nil {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for DAD of %s on %s", tentative.IPNet, intf.Attrs().Name)
+		}
+		time.Sleep(dadPollInterval)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2020 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"golang.org/x/sys/unix"
+)
+
+// withNetNSLock runs the given function holding an exclusive lock on the
+// netns, so that concurrent invocations do not race when looking up, creating
+// or deleting VRFs and when allocating routing tables. The lock is taken on
+// the netns file itself, so that different paths to the same netns share it
+// and nothing is left behind once the netns is gone.
+func withNetNSLock(netns string, toRun func() error) error {
+	f, err := os.Open(netns)
+	if os.IsNotExist(err) {
+		// Nothing to serialize, toRun will deal with the missing netns.
+		return toRun()
+	}
+	if err != nil {
+		return newError(types.ErrIOFailure, causeOf(err), "could not open netns %s: %v", netns, err)
+	}
+	defer f.Close()
+
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		return newError(types.ErrIOFailure, causeOf(err), "could not lock netns %s: %v", netns, err)
+	}
+	defer unix.Flock(int(f.Fd()), unix.LOCK_UN)
+
+	return toRun()
+}
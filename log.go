@@ -0,0 +1,170 @@
+// Copyright 2020 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// logMaxSize is the size after which the log file is rotated.
+	logMaxSize = 10 * 1024 * 1024
+	// logBackups is how many rotated log files are kept, as
+	// <logFile>.1 to <logFile>.<logBackups>.
+	logBackups = 3
+)
+
+type logLevel int
+
+const (
+	levelError logLevel = iota
+	levelInfo
+	levelDebug
+)
+
+var logLevels = map[string]logLevel{
+	"error": levelError,
+	"info":  levelInfo,
+	"debug": levelDebug,
+}
+
+var levelNames = map[logLevel]string{
+	levelError: "error",
+	levelInfo:  "info",
+	levelDebug: "debug",
+}
+
+// validateLogLevel checks that the level is a known one. An empty level
+// means info.
+func validateLogLevel(level string) error {
+	if level == "" {
+		return nil
+	}
+	if _, ok := logLevels[level]; !ok {
+		return fmt.Errorf("invalid logLevel %s", level)
+	}
+	return nil
+}
+
+// pluginLogger writes the log lines of an invocation to the configured
+// file, tagged with the invocation arguments. It discards everything
+// when no file is configured.
+type pluginLogger struct {
+	mu    sync.Mutex
+	out   *os.File
+	level logLevel
+	tags  string
+}
+
+var logger = &pluginLogger{}
+
+// setupLogging opens the log file of the configuration, if any, and tags
+// the lines with the given arguments. The returned function closes the file.
+func setupLogging(conf *VRFNetConf, args *skel.CmdArgs) (func(), error) {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+
+	logger.out = nil
+	if conf.LogFile == "" {
+		return func() {}, nil
+	}
+
+	out, err := openLogFile(conf.LogFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not open log file %s: %v", conf.LogFile, err)
+	}
+	logger.out = out
+	logger.level = levelInfo
+	if conf.LogLevel != "" {
+		logger.level = logLevels[conf.LogLevel]
+	}
+	logger.tags = fmt.Sprintf("containerID=%s ifName=%s netns=%s", args.ContainerID, args.IfName, args.Netns)
+
+	return func() {
+		logger.mu.Lock()
+		defer logger.mu.Unlock()
+		if logger.out == out {
+			logger.out = nil
+		}
+		out.Close()
+	}, nil
+}
+
+// openLogFile opens the log file for appending, rotating it first if it
+// grew over logMaxSize. The rotation is serialized across invocations
+// with a lock on a file next to the log, which unlike the log is never
+// renamed, and the size is checked under the lock so that a log that was
+// just rotated is not rotated again.
+func openLogFile(path string) (*os.File, error) {
+	lock, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return nil, fmt.Errorf("could not lock %s: %w", lock.Name(), err)
+	}
+	defer unix.Flock(int(lock.Fd()), unix.LOCK_UN)
+
+	st, err := os.Stat(path)
+	if err == nil && st.Size() >= logMaxSize {
+		for i := logBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+		}
+		if err := os.Rename(path, path+".1"); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+}
+
+func (l *pluginLogger) logf(level logLevel, format string, a ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.out == nil || level > l.level {
+		return
+	}
+	// Each line is written at once, so that the lines of concurrent
+	// invocations do not interleave.
+	line := fmt.Sprintf("%s [%s] %s %s\n", time.Now().Format(time.RFC3339Nano), levelNames[level], l.tags, fmt.Sprintf(format, a...))
+	l.out.WriteString(line)
+}
+
+// logOutcome logs how the command of the invocation ended.
+func logOutcome(cmd string, err error) {
+	if err != nil {
+		errorf("%s failed: %v", cmd, err)
+		return
+	}
+	infof("%s succeeded", cmd)
+}
+
+func debugf(format string, a ...interface{}) {
+	logger.logf(levelDebug, format, a...)
+}
+
+func infof(format string, a ...interface{}) {
+	logger.logf(levelInfo, format, a...)
+}
+
+func errorf(format string, a ...interface{}) {
+	logger.logf(levelError, format, a...)
+}
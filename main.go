@@ -17,16 +17,22 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/vishvananda/netlink"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
-	"github.com/containernetworking/cni/pkg/types/current"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
 
 	"github.com/containernetworking/plugins/pkg/ns"
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+
+	libvrf "github.com/fedepaol/vrfcni/pkg/vrf"
 )
 
 // VRFNetConf represents the vrf configuration.
@@ -35,153 +41,750 @@ type VRFNetConf struct {
 
 	// VRFName is the name of the vrf to add the interface to.
 	VRFName string `json:"vrfname"`
+	// ShortenVRFName makes names longer than 15 characters fit in a link
+	// name, by replacing their end with a hash of the whole name.
+	ShortenVRFName bool `json:"shortenVRFName"`
 	// Table is the optional name of the routing table set for the vrf
 	Table uint32 `json:"table"`
+	// TableRange is the optional range the routing table is allocated from
+	// when Table is not set.
+	TableRange *libvrf.TableRange `json:"tableRange"`
+	// DenyTables are the routing tables never given to the vrf, on top of
+	// the reserved ones (0, 253, 254 and 255).
+	DenyTables []uint32 `json:"denyTables"`
+	// TableAllocation is how the routing table is allocated when Table is
+	// not set: "sequential" (the default) takes the first free table of the
+	// range, "hash" derives it from VRFName so that it's stable across
+	// netns and restarts.
+	TableAllocation string `json:"tableAllocation"`
+	// DataDir is the optional directory where the attachments are recorded
+	// for garbage collection. Defaults to /var/lib/cni/vrf.
+	DataDir string `json:"dataDir"`
+	// Routes is the optional list of static routes to install in the vrf
+	// routing table.
+	Routes []VRFRoute `json:"routes"`
+	// StrictIsolation installs an unreachable default route in the vrf
+	// routing table, so that lookups do not fall through to the main table.
+	StrictIsolation bool `json:"strictIsolation"`
+	// MoveLocalRule moves the local table ip rule after the l3mdev one, so
+	// that local addresses of other VRFs do not shadow the VRF lookups.
+	MoveLocalRule bool `json:"moveLocalRule"`
+	// Sysctls are the l3mdev sysctls (net.ipv4.tcp_l3mdev_accept,
+	// net.ipv4.udp_l3mdev_accept and net.ipv4.raw_l3mdev_accept) to set
+	// when the first VRF of the netns is created. Their original values are
+	// restored when the last VRF is deleted.
+	Sysctls map[string]string `json:"sysctls"`
+	// WaitDAD makes ADD wait until the ipv6 addresses of the interface
+	// complete duplicate address detection.
+	WaitDAD bool `json:"waitDAD"`
+	// DADTimeout is how long ADD waits for DAD, as a duration string.
+	// Defaults to 10s.
+	DADTimeout string `json:"dadTimeout"`
+	// AnnounceAddresses makes ADD send gratuitous arps and unsolicited
+	// neighbor advertisements for the addresses of the interface, once it
+	// is enslaved to the vrf.
+	AnnounceAddresses bool `json:"announceAddresses"`
+
+	// LogFile is the optional file the plugin logs to. Once it grows over
+	// 10MB, it is rotated keeping the 3 previous files.
+	LogFile string `json:"logFile"`
+	// LogLevel is the level of the lines written to LogFile: "error",
+	// "info" (the default) or "debug", which records the netlink actions.
+	LogLevel string `json:"logLevel"`
+
+	dadTimeout time.Duration
+	tables     *libvrf.TablePolicy
+}
+
+// VRFRoute represents a static route of the vrf routing table.
+type VRFRoute struct {
+	Dst    types.IPNet `json:"dst"`
+	GW     net.IP      `json:"gw,omitempty"`
+	Metric int         `json:"metric,omitempty"`
+	// Dev is the optional output interface of the route. When not set,
+	// the kernel resolves it from the gateway using the vrf routing table.
+	Dev string `json:"dev,omitempty"`
+}
+
+// VRFInfo describes the vrf the interface was added to. ADD reports it in
+// the "vrf" field of its output, next to the fields of prevResult. Only the
+// callers reading the raw output of the plugin see it: libcni parses every
+// result into the spec types before passing it on as prevResult or
+// returning it to the runtime, and the field is dropped there. What always
+// survives is the vrf device in the interfaces of the result, which the
+// next plugins can look the routing table up from.
+type VRFInfo struct {
+	// Name is the name of the vrf device.
+	Name string `json:"name"`
+	// Table is the routing table of the vrf.
+	Table uint32 `json:"table"`
+	// Interface is the index of the vrf device in the interfaces of
+	// the result.
+	Interface int `json:"interface"`
 }
 
+var (
+	// nlh is what the plugin makes its netlink requests with. The unit
+	// tests that can't run as root replace it with an in-memory fake.
+	nlh = libvrf.Kernel()
+	// enterNetNS runs the given function in the netns with the given path.
+	enterNetNS = ns.WithNetNSPath
+)
+
 func main() {
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.PluginSupports("0.4.0"), bv.BuildString("vrf"))
+	skel.PluginMainFuncs(skel.CNIFuncs{
+		Add:    cmdAdd,
+		Check:  cmdCheck,
+		Del:    cmdDel,
+		GC:     cmdGC,
+		Status: cmdStatus,
+	}, version.All, bv.BuildString("vrf"))
 }
 
-func cmdAdd(args *skel.CmdArgs) error {
+// defaultDADTimeout is how long ADD waits for DAD when WaitDAD is set.
+const defaultDADTimeout = 10 * time.Second
+
+// errPluginNotAvailable is the error code returned by STATUS when the
+// plugin cannot serve ADD requests.
+const errPluginNotAvailable uint = 50
+
+func cmdAdd(args *skel.CmdArgs) (err error) {
 	conf, result, err := parseConf(args.StdinData)
 	if err != nil {
 		return err
 	}
 
+	closeLog, err := setupLogging(conf, args)
+	if err != nil {
+		return wrapError(err, types.ErrIOFailure, "cmdAdd failed")
+	}
+	defer closeLog()
+	defer func() { logOutcome("ADD", err) }()
+
 	if conf.PrevResult == nil {
-		return fmt.Errorf("missing prevResult from earlier plugin")
+		return configError("missing prevResult from earlier plugin")
 	}
 
-	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
-		vrf, err := findVRF(conf.VRFName)
+	if err := checkVRFNameForInterface(conf.VRFName, args.IfName); err != nil {
+		return err
+	}
+
+	// The attachment is recorded first, so that GC can clean up after
+	// an ADD that did not complete.
+	s := newStore(conf.DataDir, conf.Name)
+	err = s.save(attachment{
+		ContainerID: args.ContainerID,
+		IfName:      args.IfName,
+		Netns:       args.Netns,
+		VRFName:     conf.VRFName,
+	})
+	if err != nil {
+		return wrapError(err, types.ErrIOFailure, "cmdAdd failed")
+	}
+
+	var vrf *netlink.Vrf
+	err = withNetNSLock(args.Netns, func() error {
+		return enterNetNS(args.Netns, func(_ ns.NetNS) error {
+			rb := &rollback{}
+			var err error
+			vrf, err = addToVRF(conf, args, result, rb)
+			if err != nil {
+				if rbErr := rb.run(); rbErr != nil {
+					return fmt.Errorf("%w, rollback failed: %v", err, rbErr)
+				}
+			}
+			return err
+		})
+	})
+
+	if err != nil {
+		s.remove(args.ContainerID, args.IfName)
+		return wrapError(err, netlinkCode(err), "cmdAdd failed")
+	}
+
+	if result == nil {
+		result = &types100.Result{}
+	}
 
-		if err == nil && conf.Table != 0 && vrf.Table != conf.Table {
-			return fmt.Errorf("VRF %s already exist with different routing table %d", conf.VRFName, vrf.Table)
+	// The vrf device is appended, so that the indexes the ips of
+	// prevResult refer to are left untouched.
+	idx := addResultInterface(result, &types100.Interface{
+		Name:    vrf.Name,
+		Mac:     vrf.HardwareAddr.String(),
+		Sandbox: args.Netns,
+	})
+	info := &VRFInfo{
+		Name:      vrf.Name,
+		Table:     vrf.Table,
+		Interface: idx,
+	}
+
+	return printResult(result, info, conf.CNIVersion)
+}
+
+// addResultInterface adds the interface to the result, unless an interface
+// with the same name and sandbox is already there, and returns its index.
+func addResultInterface(result *types100.Result, intf *types100.Interface) int {
+	for i, existing := range result.Interfaces {
+		if existing.Name == intf.Name && existing.Sandbox == intf.Sandbox {
+			return i
+		}
+	}
+	result.Interfaces = append(result.Interfaces, intf)
+	return len(result.Interfaces) - 1
+}
+
+// printResult prints the result converted to the given version, with the
+// vrf information added in the "vrf" field.
+func printResult(result *types100.Result, info *VRFInfo, cniVersion string) error {
+	converted, err := result.GetAsVersion(cniVersion)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(converted)
+	if err != nil {
+		return err
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	fields["vrf"], err = json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	data, err = json.MarshalIndent(fields, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+// newManager returns the manager of the VRFs of the current netns, logging
+// its actions at debug level.
+func newManager(conf *VRFNetConf) *libvrf.Manager {
+	m := libvrf.NewManager(nlh, conf.tables)
+	m.Logf = debugf
+	return m
+}
+
+// addToVRF adds the interface to the VRF, creating it if needed, and returns
+// the VRF. The actions undoing each change are collected in the given rollback.
+func addToVRF(conf *VRFNetConf, args *skel.CmdArgs, result *types100.Result, rb *rollback) (*netlink.Vrf, error) {
+	m := newManager(conf)
+	vrf, created, err := setupVRF(m, conf, args.ContainerID, rb)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.MoveLocalRule {
+		changed, err := moveLocalRules()
+		if changed {
+			rb.add(restoreLocalRules)
+		}
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		if _, ok := err.(netlink.LinkNotFoundError); ok {
-			vrf, err = createVRF(conf.VRFName, conf.Table)
+	if conf.StrictIsolation && checkUnreachableDefaultRoutes(vrf) != nil {
+		rb.add(func() error {
+			return delUnreachableDefaultRoutes(vrf)
+		})
+		err = addUnreachableDefaultRoutes(vrf)
+		if err != nil {
+			return nil, err
 		}
+	}
+
+	undo, err := m.Attach(vrf, args.IfName)
+	if undo != nil {
+		rb.add(undo)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Static routes of an existing VRF are shared with its other interfaces,
+	// so they are only removed if the VRF was created here.
+	if created {
+		rb.add(func() error {
+			return delVRFRoutes(vrf, conf.Routes)
+		})
+	}
+	err = addVRFRoutes(vrf, conf.Routes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = settleAddresses(conf, args.IfName, interfaceIPs(result, args.IfName))
+	if err != nil {
+		return nil, err
+	}
+	return vrf, nil
+}
 
+// settleAddresses waits for the ipv6 DAD of the interface and announces the
+// given addresses of it, when configured to.
+func settleAddresses(conf *VRFNetConf, ifName string, ips []*types100.IPConfig) error {
+	if !conf.WaitDAD && !conf.AnnounceAddresses {
+		return nil
+	}
+	link, err := nlh.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("could not get link by name %s", ifName)
+	}
+
+	if conf.WaitDAD {
+		err = waitForDAD(link, conf.dadTimeout)
 		if err != nil {
 			return err
 		}
+	}
+	if conf.AnnounceAddresses {
+		return announceAddresses(link, ips)
+	}
+	return nil
+}
+
+// setupVRF returns the VRF, creating it if needed, and applies the
+// configured sysctls when it's the first VRF of the netns. It tells if
+// the VRF was created.
+func setupVRF(m *libvrf.Manager, conf *VRFNetConf, containerID string, rb *rollback) (*netlink.Vrf, bool, error) {
+	first := false
+	if len(conf.Sysctls) > 0 {
+		vrfs, err := m.VRFs()
+		if err != nil {
+			return nil, false, err
+		}
+		first = len(vrfs) == 0
+	}
+
+	vrf, created, err := m.Ensure(conf.VRFName, conf.Table)
+	if err != nil {
+		return nil, false, err
+	}
+	if !created {
+		return vrf, false, nil
+	}
+	rb.add(func() error {
+		return m.Delete(vrf)
+	})
+
+	if !first {
+		return vrf, true, nil
+	}
 
-		err = addInterface(vrf, args.IfName)
+	sysctls := newSysctlStore(conf.DataDir)
+	original, err := applySysctls(conf.Sysctls)
+	rb.add(func() error {
+		err := restoreSysctls(original)
 		if err != nil {
 			return err
 		}
-		return nil
+		return sysctls.remove(containerID)
 	})
+	if err != nil {
+		return nil, false, err
+	}
+	err = sysctls.save(containerID, original)
+	if err != nil {
+		return nil, false, err
+	}
+	return vrf, true, nil
+}
 
+func cmdDel(args *skel.CmdArgs) (err error) {
+	conf, _, err := parseConf(args.StdinData)
 	if err != nil {
-		return fmt.Errorf("cmdAdd failed: %v", err)
+		return err
 	}
 
-	if result == nil {
-		result = &current.Result{}
+	closeLog, err := setupLogging(conf, args)
+	if err != nil {
+		return wrapError(err, types.ErrIOFailure, "cmdDel failed")
+	}
+	defer closeLog()
+	defer func() { logOutcome("DEL", err) }()
+
+	err = removeInterface(conf, attachment{
+		ContainerID: args.ContainerID,
+		IfName:      args.IfName,
+		Netns:       args.Netns,
+		VRFName:     conf.VRFName,
+	})
+	if err != nil {
+		return wrapError(err, netlinkCode(err), "cmdDel failed")
 	}
 
-	return types.PrintResult(result, conf.CNIVersion)
+	err = newStore(conf.DataDir, conf.Name).remove(args.ContainerID, args.IfName)
+	if err != nil {
+		return wrapError(err, types.ErrIOFailure, "cmdDel failed")
+	}
+	return nil
 }
 
-func cmdDel(args *skel.CmdArgs) error {
-	conf, _, err := parseConf(args.StdinData)
+// removeInterface removes the interface of the attachment from its VRF,
+// deleting the VRF and its static routes when no interfaces are left.
+// When the last VRF of the netns is deleted, the original sysctl values
+// are restored. Resources that are already gone are not considered an error.
+func removeInterface(conf *VRFNetConf, a attachment) error {
+	sysctls := newSysctlStore(conf.DataDir)
+	if a.Netns == "" {
+		return nil
+	}
+
+	err := withNetNSLock(a.Netns, func() error {
+		return enterNetNS(a.Netns, func(_ ns.NetNS) error {
+			return removeFromVRF(conf, a, sysctls)
+		})
+	})
+
+	if _, ok := err.(ns.NSPathNotExistErr); ok {
+		// The netns is already gone, so is everything we created inside it.
+		return sysctls.remove(a.ContainerID)
+	}
+	return err
+}
+
+// removeFromVRF removes the interface of the attachment from its VRF,
+// deleting the VRF when no interfaces are left.
+func removeFromVRF(conf *VRFNetConf, a attachment, sysctls *sysctlStore) error {
+	vrf, err := findVRF(a.VRFName)
+	if libvrf.IsLinkNotFound(err) {
+		// The VRF is already gone, nothing to do.
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
-		vrf, err := findVRF(conf.VRFName)
-		if err != nil {
-			return err
+
+	m := newManager(conf)
+	// The links are dumped once, before the interface leaves the VRF.
+	members, err := m.Members(vrf)
+	if err != nil {
+		return err
+	}
+	vrfs, err := m.VRFs()
+	if err != nil {
+		return err
+	}
+	last := true
+	for _, l := range members {
+		if l.Attrs().Name != a.IfName {
+			last = false
+			break
 		}
+	}
 
-		err = resetMaster(args.IfName)
+	errs := make([]error, 0)
+	// Meaning, we are deleting the last interface assigned to the VRF.
+	// The static routes go first, as Detach moves the ipv6 routes through
+	// the interface back to the main table.
+	if last {
+		err = delVRFRoutes(vrf, conf.Routes)
 		if err != nil {
-			return err
+			errs = append(errs, err)
 		}
+	}
+	// A failed Detach does not keep an otherwise empty VRF around, as
+	// deleting it releases the interface anyway.
+	err = m.Detach(vrf, a.IfName)
+	if err != nil {
+		errs = append(errs, err)
+	}
 
-		interfaces, err := assignedInterfaces(vrf)
+	if last {
+		// The unreachable routes have no output interface, so they are
+		// not flushed with the VRF and would keep its table in use.
+		if conf.StrictIsolation {
+			err = delUnreachableDefaultRoutes(vrf)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+		err = m.Delete(vrf)
 		if err != nil {
-			return err
+			errs = append(errs, err)
+			return joinErrors(errs)
 		}
 
-		// Meaning, we are deleting the last interface assigned to the VRF
-		if len(interfaces) == 0 {
-			err = netlink.LinkDel(vrf)
+		// The VRF just deleted was the last one of the netns.
+		if len(vrfs) == 1 {
+			err = restoreSavedSysctls(sysctls, a.ContainerID)
 			if err != nil {
-				return err
+				errs = append(errs, err)
 			}
 		}
-		return nil
-	})
+	}
+	return joinErrors(errs)
+}
 
+// restoreSavedSysctls restores the original sysctl values of the sandbox.
+func restoreSavedSysctls(sysctls *sysctlStore, containerID string) error {
+	original, err := sysctls.load(containerID)
 	if err != nil {
-		return fmt.Errorf("cmdDel failed: %v", err)
+		return err
 	}
-	return nil
+	err = restoreSysctls(original)
+	if err != nil {
+		return err
+	}
+	return sysctls.remove(containerID)
 }
 
-func cmdCheck(args *skel.CmdArgs) error {
+// cmdGC removes the interfaces from the VRFs of all the recorded attachments
+// that are not listed as valid anymore.
+func cmdGC(args *skel.CmdArgs) (err error) {
 	conf, _, err := parseConf(args.StdinData)
 	if err != nil {
 		return err
 	}
 
+	closeLog, err := setupLogging(conf, args)
+	if err != nil {
+		return wrapError(err, types.ErrIOFailure, "cmdGC failed")
+	}
+	defer closeLog()
+	defer func() { logOutcome("GC", err) }()
+
+	valid := make(map[types.GCAttachment]struct{}, len(conf.ValidAttachments))
+	for _, a := range conf.ValidAttachments {
+		valid[a] = struct{}{}
+	}
+
+	s := newStore(conf.DataDir, conf.Name)
+	attachments, err := s.list()
+	if err != nil {
+		return wrapError(err, types.ErrIOFailure, "cmdGC failed")
+	}
+
+	errs := make([]error, 0)
+	for _, a := range attachments {
+		if _, ok := valid[types.GCAttachment{ContainerID: a.ContainerID, IfName: a.IfName}]; ok {
+			continue
+		}
+		err = removeInterface(conf, a)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s/%s: %w", a.ContainerID, a.IfName, err))
+			continue
+		}
+		err = s.remove(a.ContainerID, a.IfName)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := joinErrors(errs); err != nil {
+		return wrapError(err, netlinkCode(err), "cmdGC failed")
+	}
+	return nil
+}
+
+// cmdStatus reports whether the node is able to create VRFs.
+func cmdStatus(args *skel.CmdArgs) error {
+	if _, _, err := parseConf(args.StdinData); err != nil {
+		return err
+	}
+
+	if err := vrfKernelSupport(); err != nil {
+		return types.NewError(errPluginNotAvailable, "VRF kernel support not available", err.Error())
+	}
+	return nil
+}
+
+func cmdCheck(args *skel.CmdArgs) (err error) {
+	conf, result, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	closeLog, err := setupLogging(conf, args)
+	if err != nil {
+		return wrapError(err, types.ErrIOFailure, "cmdCheck failed")
+	}
+	defer closeLog()
+	defer func() { logOutcome("CHECK", err) }()
+
 	// Ensure we have previous result.
 	if conf.PrevResult == nil {
-		return fmt.Errorf("missing prevResult from earlier plugin")
+		return configError("missing prevResult from earlier plugin")
+	}
+
+	if err := checkVRFNameForInterface(conf.VRFName, args.IfName); err != nil {
+		return err
 	}
 
-	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+	err = enterNetNS(args.Netns, func(_ ns.NetNS) error {
 		vrf, err := findVRF(conf.VRFName)
+		if libvrf.IsLinkNotFound(err) {
+			return newError(errVRFNotFound, "link "+conf.VRFName, "VRF %s not found", conf.VRFName)
+		}
 		if err != nil {
 			return err
 		}
-		vrfInterfaces, err := assignedInterfaces(vrf)
 
-		found := false
-		for _, intf := range vrfInterfaces {
-			if intf.Attrs().Name == args.IfName {
-				found = true
-				break
-			}
+		if vrf.Attrs().Flags&net.FlagUp == 0 {
+			return driftError("link "+conf.VRFName, "VRF %s is down", conf.VRFName)
+		}
+
+		if conf.Table != 0 && vrf.Table != conf.Table {
+			return newError(errTableConflict, fmt.Sprintf("table %d", vrf.Table), "VRF %s has routing table %d, expected %d", conf.VRFName, vrf.Table, conf.Table)
 		}
-		if !found {
-			return fmt.Errorf("Failed to find %s associated to vrf %s", args.IfName, conf.VRFName)
+
+		intf, err := nlh.LinkByName(args.IfName)
+		if libvrf.IsLinkNotFound(err) {
+			return driftError("link "+args.IfName, "interface %s not found", args.IfName)
 		}
-		return nil
+		if err != nil {
+			return fmt.Errorf("could not get link by name %s: %w", args.IfName, err)
+		}
+		if intf.Attrs().MasterIndex != vrf.Index {
+			return driftError("link "+args.IfName, "interface %s is not enslaved to VRF %s", args.IfName, conf.VRFName)
+		}
+
+		err = checkAddresses(intf, interfaceIPs(result, args.IfName))
+		if err != nil {
+			return err
+		}
+
+		if conf.StrictIsolation {
+			err = checkUnreachableDefaultRoutes(vrf)
+			if err != nil {
+				return err
+			}
+		}
+
+		return checkVRFRoutes(vrf, conf.Routes)
 	})
+	if err != nil {
+		return wrapError(err, netlinkCode(err), "cmdCheck failed")
+	}
 
 	return nil
 }
 
-func parseConf(data []byte) (*VRFNetConf, *current.Result, error) {
+// interfaceIPs returns the ips of the given result that are assigned to the
+// interface with the given name. The ips with no interface index, and all of
+// them when the result has a single interface, belong to the given one.
+func interfaceIPs(result *types100.Result, ifName string) []*types100.IPConfig {
+	res := make([]*types100.IPConfig, 0)
+	for _, ip := range result.IPs {
+		if ip.Interface == nil || len(result.Interfaces) <= 1 {
+			res = append(res, ip)
+			continue
+		}
+		idx := *ip.Interface
+		if idx < 0 || idx >= len(result.Interfaces) || result.Interfaces[idx].Name != ifName {
+			continue
+		}
+		res = append(res, ip)
+	}
+	return res
+}
+
+// rollback collects the actions undoing the changes made by a
+// failed ADD, and runs them in reverse order.
+type rollback struct {
+	undo []func() error
+}
+
+func (r *rollback) add(f func() error) {
+	r.undo = append(r.undo, f)
+}
+
+// run undoes all the changes, going on even if some of them fail.
+func (r *rollback) run() error {
+	errs := make([]error, 0)
+	for i := len(r.undo) - 1; i >= 0; i-- {
+		if err := r.undo[i](); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return joinErrors(errs)
+}
+
+// joinErrors merges the given errors into a single one, returning nil
+// if there are none.
+func joinErrors(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	msgs := make([]string, 0, len(errs))
+	for _, e := range errs {
+		msgs = append(msgs, e.Error())
+	}
+	return fmt.Errorf("%s", strings.Join(msgs, "; "))
+}
+
+func parseConf(data []byte) (*VRFNetConf, *types100.Result, error) {
 	conf := VRFNetConf{}
 	if err := json.Unmarshal(data, &conf); err != nil {
-		return nil, nil, fmt.Errorf("failed to load netconf: %v", err)
+		return nil, nil, newError(types.ErrDecodingFailure, err.Error(), "failed to load netconf: %v", err)
+	}
+
+	if err := validateVRFName(conf.VRFName, conf.ShortenVRFName); err != nil {
+		return nil, nil, configError("%v", err)
+	}
+	if conf.ShortenVRFName {
+		conf.VRFName = shortVRFName(conf.VRFName)
 	}
 
-	if conf.VRFName == "" {
-		return nil, nil, fmt.Errorf("configuration is expected to have a valid vrf name")
+	tables, err := libvrf.NewTablePolicy(conf.TableRange, conf.DenyTables, conf.TableAllocation)
+	if err != nil {
+		return nil, nil, configError("%v", err)
+	}
+	if conf.Table != 0 {
+		if err := tables.Validate(conf.Table); err != nil {
+			return nil, nil, configError("%v", err)
+		}
+	}
+	conf.tables = tables
+
+	conf.dadTimeout = defaultDADTimeout
+	if conf.DADTimeout != "" {
+		timeout, err := time.ParseDuration(conf.DADTimeout)
+		if err != nil {
+			return nil, nil, configError("invalid dadTimeout %s: %v", conf.DADTimeout, err)
+		}
+		conf.dadTimeout = timeout
+	}
+
+	if err := validateSysctls(conf.Sysctls); err != nil {
+		return nil, nil, configError("%v", err)
+	}
+
+	if err := validateLogLevel(conf.LogLevel); err != nil {
+		return nil, nil, configError("%v", err)
+	}
+
+	for _, r := range conf.Routes {
+		if r.Dst.IP == nil {
+			return nil, nil, configError("routes are expected to have a destination")
+		}
+		if r.GW == nil && r.Dev == "" {
+			return nil, nil, configError("route %s is expected to have a gateway or a device", (*net.IPNet)(&r.Dst).String())
+		}
 	}
 
 	if conf.RawPrevResult == nil {
 		// return early if there was no previous result, which is allowed for DEL calls
-		return &conf, &current.Result{}, nil
+		return &conf, &types100.Result{}, nil
 	}
 
 	// Parse previous result.
-	var result *current.Result
-	var err error
+	var result *types100.Result
 	if err = version.ParsePrevResult(&conf.NetConf); err != nil {
-		return nil, nil, fmt.Errorf("could not parse prevResult: %v", err)
+		return nil, nil, newError(types.ErrDecodingFailure, err.Error(), "could not parse prevResult: %v", err)
 	}
 
-	result, err = current.NewResultFromResult(conf.PrevResult)
+	result, err = types100.NewResultFromResult(conf.PrevResult)
 	if err != nil {
-		return nil, nil, fmt.Errorf("could not convert result to current version: %v", err)
+		return nil, nil, newError(types.ErrDecodingFailure, err.Error(), "could not convert result to current version: %v", err)
 	}
 
 	return &conf, result, nil
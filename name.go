@@ -0,0 +1,76 @@
+// Copyright 2020 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxVRFNameLen is the longest name the kernel accepts for a link.
+const maxVRFNameLen = unix.IFNAMSIZ - 1
+
+// shortNameHashLen is how many characters of a shortened name are taken
+// by the hash of the original one.
+const shortNameHashLen = 8
+
+// validateVRFName checks that the name can be used for a link. When shorten
+// is set, names that are too long are accepted, as they are shortened later.
+func validateVRFName(name string, shorten bool) error {
+	if name == "" {
+		return fmt.Errorf("configuration is expected to have a valid vrf name")
+	}
+	if name == "." || name == ".." {
+		return fmt.Errorf("invalid vrf name %q", name)
+	}
+	if strings.ContainsRune(name, '/') {
+		return fmt.Errorf("invalid vrf name %q: must not contain '/'", name)
+	}
+	if strings.IndexFunc(name, unicode.IsSpace) != -1 {
+		return fmt.Errorf("invalid vrf name %q: must not contain whitespaces", name)
+	}
+	if strings.ContainsRune(name, ':') {
+		return fmt.Errorf("invalid vrf name %q: must not contain ':'", name)
+	}
+	if len(name) > maxVRFNameLen && !shorten {
+		return fmt.Errorf("invalid vrf name %q: longer than %d characters", name, maxVRFNameLen)
+	}
+	return nil
+}
+
+// shortVRFName returns the name unchanged if it fits in a link name, or
+// its prefix followed by a hash of the whole name otherwise, so that
+// different long names are unlikely to end up with the same short one.
+func shortVRFName(name string) string {
+	if len(name) <= maxVRFNameLen {
+		return name
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return fmt.Sprintf("%s%0*x", name[:maxVRFNameLen-shortNameHashLen], shortNameHashLen, h.Sum32())
+}
+
+// checkVRFNameForInterface checks that the vrf does not have the name of
+// the interface it is going to be added to.
+func checkVRFNameForInterface(vrfName, ifName string) error {
+	if vrfName == ifName {
+		return configError("vrf name %s is the same as the interface name", vrfName)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2020 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vrf
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors the failures of a Manager can be matched against with errors.Is.
+var (
+	// ErrTableConflict is returned when the routing table of a VRF is not
+	// the requested one, or is used by another VRF.
+	ErrTableConflict = errors.New("routing table conflict")
+	// ErrHasMaster is returned when attaching an interface that is
+	// already enslaved to another master.
+	ErrHasMaster = errors.New("interface has a master")
+	// ErrReservedTable is returned when a VRF is given a routing table
+	// that the policy does not allow.
+	ErrReservedTable = errors.New("reserved routing table")
+	// ErrNoTableAvailable is returned when all the routing tables the
+	// policy allows are taken.
+	ErrNoTableAvailable = errors.New("no routing table available")
+	// ErrInterfaceNotFound is returned when attaching an interface that
+	// does not exist.
+	ErrInterfaceNotFound = errors.New("interface not found")
+)
+
+// Error is an error with its own message that matches one of the errors
+// above. Subject names the link or the routing table it is about.
+type Error struct {
+	Kind    error
+	Subject string
+	msg     string
+}
+
+func newError(kind error, subject, format string, a ...interface{}) error {
+	return &Error{Kind: kind, Subject: subject, msg: fmt.Sprintf(format, a...)}
+}
+
+func (e *Error) Error() string {
+	return e.msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Kind
+}
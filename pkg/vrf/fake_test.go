@@ -0,0 +1,203 @@
+// Copyright 2020 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vrf_test
+
+import (
+	"errors"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/fedepaol/vrfcni/pkg/vrf"
+	"github.com/fedepaol/vrfcni/pkg/vrf/vrftest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("manager on a fake netlink", func() {
+	var fake *vrftest.Fake
+	var m *vrf.Manager
+	const (
+		IF0Name  = "eth0"
+		VRF0Name = "vrf0"
+		VRF1Name = "vrf1"
+	)
+
+	BeforeEach(func() {
+		fake = vrftest.NewFake()
+		m = vrf.NewManager(fake, nil)
+
+		Expect(fake.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: IF0Name}})).To(Succeed())
+		link, err := fake.LinkByName(IF0Name)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fake.LinkSetUp(link)).To(Succeed())
+		for _, a := range []string{"10.0.0.2/24", "2001:db8::2/64"} {
+			addr, err := netlink.ParseAddr(a)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fake.AddrAdd(link, addr)).To(Succeed())
+		}
+		_, dst, _ := net.ParseCIDR("2001:db8:1::/64")
+		Expect(fake.RouteReplace(&netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       dst,
+			Gw:        net.ParseIP("2001:db8::1"),
+		})).To(Succeed())
+	})
+
+	It("allocates the tables not used by VRFs, routes or rules", func() {
+		_, dst, _ := net.ParseCIDR("10.1.0.0/24")
+		Expect(fake.RouteReplace(&netlink.Route{Dst: dst, Type: unix.RTN_BLACKHOLE, Table: 1})).To(Succeed())
+		rule := netlink.NewRule()
+		rule.Family = netlink.FAMILY_V4
+		rule.Table = 2
+		rule.Priority = 100
+		Expect(fake.RuleAdd(rule)).To(Succeed())
+
+		vrf0, created, err := m.Ensure(VRF0Name, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(created).To(BeTrue())
+		Expect(vrf0.Table).To(Equal(uint32(3)))
+
+		vrf1, _, err := m.Ensure(VRF1Name, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(vrf1.Table).To(Equal(uint32(4)))
+
+		vrfs, err := m.VRFs()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(vrfs).To(HaveLen(2))
+	})
+
+	It("fails on conflicting tables", func() {
+		_, _, err := m.Ensure(VRF0Name, 100)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, _, err = m.Ensure(VRF0Name, 101)
+		Expect(errors.Is(err, vrf.ErrTableConflict)).To(BeTrue())
+		_, _, err = m.Ensure(VRF1Name, 100)
+		Expect(errors.Is(err, vrf.ErrTableConflict)).To(BeTrue())
+		_, _, err = m.Ensure(VRF1Name, 255)
+		Expect(errors.Is(err, vrf.ErrReservedTable)).To(BeTrue())
+	})
+
+	It("restores the l3mdev rules", func() {
+		_, _, err := m.Ensure(VRF0Name, 0)
+		Expect(err).NotTo(HaveOccurred())
+		fake.DelL3mdevRules()
+
+		_, _, err = m.Ensure(VRF1Name, 0)
+		Expect(err).NotTo(HaveOccurred())
+		for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+			found, err := vrf.HasL3mdevRule(fake, family)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(found).To(BeTrue())
+		}
+	})
+
+	It("keeps the ipv6 state of the interfaces across master changes", func() {
+		vrf0, _, err := m.Ensure(VRF0Name, 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = m.Attach(vrf0, IF0Name)
+		Expect(err).NotTo(HaveOccurred())
+		members, err := m.Members(vrf0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(members).To(HaveLen(1))
+
+		link, err := fake.LinkByName(IF0Name)
+		Expect(err).NotTo(HaveOccurred())
+		addrs, err := fake.AddrList(link, netlink.FAMILY_V6)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(addrs).To(HaveLen(1))
+		routes, err := fake.RouteListFiltered(netlink.FAMILY_V6, &netlink.Route{Table: int(vrf0.Table), Gw: net.ParseIP("2001:db8::1")},
+			netlink.RT_FILTER_TABLE|netlink.RT_FILTER_GW)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(routes).To(HaveLen(1))
+
+		Expect(m.Detach(vrf0, IF0Name)).To(Succeed())
+		members, err = m.Members(vrf0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(members).To(BeEmpty())
+		addrs, err = fake.AddrList(link, netlink.FAMILY_V6)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(addrs).To(HaveLen(1))
+		routes, err = fake.RouteListFiltered(netlink.FAMILY_V6, &netlink.Route{Gw: net.ParseIP("2001:db8::1")}, netlink.RT_FILTER_GW)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(routes).To(HaveLen(1))
+	})
+
+	It("moves the ipv4 routes of the main table to the VRF and back on undo", func() {
+		link, err := fake.LinkByName(IF0Name)
+		Expect(err).NotTo(HaveOccurred())
+		_, dst, _ := net.ParseCIDR("10.1.0.0/16")
+		Expect(fake.RouteReplace(&netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       dst,
+			Gw:        net.ParseIP("10.0.0.1"),
+		})).To(Succeed())
+		vrf0, _, err := m.Ensure(VRF0Name, 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		undo, err := m.Attach(vrf0, IF0Name)
+		Expect(err).NotTo(HaveOccurred())
+		routes, err := fake.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Dst: dst}, netlink.RT_FILTER_DST|netlink.RT_FILTER_TABLE)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(routes).To(HaveLen(1))
+		Expect(routes[0].Table).To(Equal(int(vrf0.Table)))
+
+		Expect(undo()).To(Succeed())
+		link, err = fake.LinkByName(IF0Name)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(link.Attrs().MasterIndex).To(BeZero())
+		routes, err = fake.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Dst: dst}, netlink.RT_FILTER_DST|netlink.RT_FILTER_TABLE)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(routes).To(HaveLen(1))
+		Expect(routes[0].Table).To(Equal(unix.RT_TABLE_MAIN))
+	})
+
+	It("does not attach interfaces with a master", func() {
+		vrf0, _, err := m.Ensure(VRF0Name, 0)
+		Expect(err).NotTo(HaveOccurred())
+		vrf1, _, err := m.Ensure(VRF1Name, 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = m.Attach(vrf0, IF0Name)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = m.Attach(vrf1, IF0Name)
+		Expect(errors.Is(err, vrf.ErrHasMaster)).To(BeTrue())
+
+		// Detaching from the wrong VRF leaves the interface untouched.
+		Expect(m.Detach(vrf1, IF0Name)).To(Succeed())
+		members, err := m.Members(vrf0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(members).To(HaveLen(1))
+	})
+
+	It("releases the members of a deleted VRF", func() {
+		vrf0, _, err := m.Ensure(VRF0Name, 0)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = m.Attach(vrf0, IF0Name)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(m.Delete(vrf0)).To(Succeed())
+		link, err := fake.LinkByName(IF0Name)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(link.Attrs().MasterIndex).To(BeZero())
+
+		_, err = vrf.FindVRF(fake, VRF0Name)
+		Expect(vrf.IsLinkNotFound(err)).To(BeTrue())
+	})
+})
@@ -0,0 +1,116 @@
+// Copyright 2020 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vrf
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// settableAddrFlags are the address flags that can be passed when adding an
+// address, the others are managed by the kernel.
+const settableAddrFlags = unix.IFA_F_NODAD | unix.IFA_F_OPTIMISTIC | unix.IFA_F_HOMEADDRESS |
+	unix.IFA_F_MANAGETEMPADDR | unix.IFA_F_NOPREFIXROUTE | unix.IFA_F_MCAUTOJOIN
+
+// IPv6State is the ipv6 configuration of an interface. IPV6 addresses are not
+// maintained when the interface changes master unless
+// sysctl -w net.ipv6.conf.all.keep_addr_on_down=1 is called, and the routes
+// through the interface go away with them, so we save them and restore them
+// back.
+type IPv6State struct {
+	h         Netlink
+	addresses []netlink.Addr
+	routes    []netlink.Route
+}
+
+// SaveIPv6State returns the ipv6 addresses of the interface, and the ipv6
+// routes through it in any table, excluding the ones installed by the kernel.
+func SaveIPv6State(h Netlink, intf netlink.Link) (*IPv6State, error) {
+	addresses, err := h.AddrList(intf, netlink.FAMILY_V6)
+	if err != nil {
+		return nil, fmt.Errorf("failed getting ipv6 addresses for %s: %w", intf.Attrs().Name, err)
+	}
+
+	filter := &netlink.Route{
+		LinkIndex: intf.Attrs().Index,
+		Table:     unix.RT_TABLE_UNSPEC,
+	}
+	routes, err := h.RouteListFiltered(netlink.FAMILY_V6, filter, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, fmt.Errorf("failed getting ipv6 routes for %s: %w", intf.Attrs().Name, err)
+	}
+
+	res := &IPv6State{
+		h:         h,
+		addresses: addresses,
+		routes:    make([]netlink.Route, 0, len(routes)),
+	}
+	for _, r := range routes {
+		// Connected and local routes come back with the addresses.
+		if r.Protocol == unix.RTPROT_KERNEL {
+			continue
+		}
+		res.routes = append(res.routes, r)
+	}
+	return res, nil
+}
+
+// Restore re-adds to the interface the saved addresses that are not assigned
+// to it anymore, keeping their flags and lifetimes. Addresses that already
+// completed DAD are added without going through it again. The saved routes
+// are then reinstalled, moving the ones that were in the fromTable table
+// to the toTable one.
+func (s *IPv6State) Restore(intf netlink.Link, fromTable, toTable int) error {
+	afterAddresses, err := s.h.AddrList(intf, netlink.FAMILY_V6)
+	if err != nil {
+		return fmt.Errorf("failed getting ipv6 new addresses for %s", intf.Attrs().Name)
+	}
+
+	// Since keeping the ipv6 address depends on net.ipv6.conf.all.keep_addr_on_down ,
+	// we check if the new interface does not have them and in case we restore them.
+CONTINUE:
+	for _, toFind := range s.addresses {
+		for _, current := range afterAddresses {
+			if toFind.Equal(current) {
+				continue CONTINUE
+			}
+		}
+		// Not found, re-adding it
+		toAdd := toFind
+		toAdd.Flags &= settableAddrFlags
+		if toFind.Flags&(unix.IFA_F_TENTATIVE|unix.IFA_F_DADFAILED) == 0 {
+			toAdd.Flags |= unix.IFA_F_NODAD
+		}
+		err = s.h.AddrAdd(intf, &toAdd)
+		if err != nil {
+			return fmt.Errorf("could not restore address %s to %s: %w", toFind, intf.Attrs().Name, err)
+		}
+	}
+
+	for _, r := range s.routes {
+		toAdd := r
+		if toAdd.Table == fromTable {
+			toAdd.Table = toTable
+		}
+		toAdd.Flags &= unix.RTNH_F_ONLINK
+		err = s.h.RouteReplace(&toAdd)
+		if err != nil {
+			return fmt.Errorf("could not restore route %s to %s: %w", r, intf.Attrs().Name, err)
+		}
+	}
+	return nil
+}
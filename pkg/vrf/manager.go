@@ -0,0 +1,388 @@
+// Copyright 2020 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vrf
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Manager creates the VRFs of the current netns and moves interfaces in
+// and out of them. The links are dumped at most once between two changes,
+// so a Manager is meant to serve a single sequence of operations on one
+// netns, and is not safe for concurrent use.
+type Manager struct {
+	h      Netlink
+	tables *TablePolicy
+	links  *Snapshot
+
+	// Logf, when set, is called with a description of each netlink
+	// change and of the allocated tables.
+	Logf func(format string, a ...interface{})
+}
+
+// NewManager returns a Manager that goes through the given Netlink, usually
+// Kernel, and allocates the routing tables of the VRFs it creates according
+// to the given policy. A nil policy allocates the first free table starting
+// from 1.
+func NewManager(h Netlink, tables *TablePolicy) *Manager {
+	if tables == nil {
+		tables, _ = NewTablePolicy(nil, nil, AllocationSequential)
+	}
+	return &Manager{h: h, tables: tables}
+}
+
+func (m *Manager) logf(format string, a ...interface{}) {
+	if m.Logf != nil {
+		m.Logf(format, a...)
+	}
+}
+
+// snapshot returns the links of the netns, dumping them if they changed
+// since the last dump.
+func (m *Manager) snapshot() (*Snapshot, error) {
+	if m.links != nil {
+		return m.links, nil
+	}
+	links, err := TakeSnapshot(m.h)
+	if err != nil {
+		return nil, err
+	}
+	m.links = links
+	return links, nil
+}
+
+// VRFs returns the VRFs of the netns, sorted by name.
+func (m *Manager) VRFs() ([]*netlink.Vrf, error) {
+	links, err := m.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return links.VRFs(), nil
+}
+
+// Members returns the interfaces enslaved to the given VRF.
+func (m *Manager) Members(vrf *netlink.Vrf) ([]netlink.Link, error) {
+	links, err := m.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return links.AssignedInterfaces(vrf), nil
+}
+
+// Ensure returns the VRF with the given name, creating it if it does not
+// exist, and tells if it was created. When table is 0, the routing table
+// of a new VRF is allocated, otherwise an existing VRF must use that table.
+func (m *Manager) Ensure(name string, table uint32) (*netlink.Vrf, bool, error) {
+	vrf, err := FindVRF(m.h, name)
+	if err == nil {
+		if table != 0 && vrf.Table != table {
+			return nil, false, newError(ErrTableConflict, fmt.Sprintf("table %d", vrf.Table), "VRF %s already exist with different routing table %d", name, vrf.Table)
+		}
+		return vrf, false, nil
+	}
+	if !IsLinkNotFound(err) {
+		return nil, false, err
+	}
+
+	vrf, err = m.create(name, table)
+	if err != nil {
+		return nil, false, err
+	}
+	return vrf, true, nil
+}
+
+// create creates a new VRF and sets it up.
+func (m *Manager) create(name string, table uint32) (*netlink.Vrf, error) {
+	links, err := m.snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	if table != 0 {
+		if err := m.tables.Validate(table); err != nil {
+			return nil, fmt.Errorf("Can't create VRF %s: %w", name, err)
+		}
+		if vrf, ok := links.VRFForTable(table); ok {
+			return nil, newError(ErrTableConflict, fmt.Sprintf("table %d", table), "Can't create VRF %s with tableid %d, already used by %s", name, table, vrf.Name)
+		}
+	} else {
+		table, err = m.AllocateTable(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	vrf := &netlink.Vrf{
+		LinkAttrs: netlink.LinkAttrs{
+			Name: name,
+		},
+		Table: table,
+	}
+
+	m.logf("Ensure: adding vrf %s with table %d", name, table)
+	m.links = nil
+	err = m.h.LinkAdd(vrf)
+	if err != nil {
+		return nil, fmt.Errorf("could not add VRF %s: %w", name, err)
+	}
+	m.logf("Ensure: setting vrf %s up", name)
+	err = m.h.LinkSetUp(vrf)
+	if err != nil {
+		m.logf("Ensure: deleting vrf %s", name)
+		m.h.LinkDel(vrf)
+		return nil, fmt.Errorf("could not set link up for VRF %s: %w", name, err)
+	}
+
+	// The kernel adds the l3mdev rules when the first VRF is created,
+	// but they may have been removed since.
+	m.logf("Ensure: ensuring the l3mdev rules")
+	err = ensureL3mdevRules(m.h)
+	if err != nil {
+		m.logf("Ensure: deleting vrf %s", name)
+		m.h.LinkDel(vrf)
+		return nil, fmt.Errorf("could not ensure l3mdev rules for VRF %s: %w", name, err)
+	}
+
+	// The link is read back for the attributes the kernel fills in,
+	// such as the mac address.
+	created, err := FindVRF(m.h, name)
+	if err != nil {
+		m.logf("Ensure: deleting vrf %s", name)
+		m.h.LinkDel(vrf)
+		return nil, fmt.Errorf("could not get VRF %s: %w", name, err)
+	}
+	return created, nil
+}
+
+// Delete deletes the VRF. Its members are released by the kernel.
+func (m *Manager) Delete(vrf *netlink.Vrf) error {
+	m.logf("Delete: deleting vrf %s", vrf.Name)
+	m.links = nil
+	err := m.h.LinkDel(vrf)
+	if err != nil {
+		return fmt.Errorf("could not delete VRF %s: %w", vrf.Name, err)
+	}
+	return nil
+}
+
+// AllocateTable returns a routing table for the VRF with the given name,
+// allowed by the policy and not used by any VRF, route or ip rule.
+func (m *Manager) AllocateTable(name string) (uint32, error) {
+	links, err := m.snapshot()
+	if err != nil {
+		return 0, err
+	}
+	taken, err := usedTables(m.h)
+	if err != nil {
+		return 0, fmt.Errorf("AllocateTable: %w", err)
+	}
+	taken = append(taken, links.Tables()...)
+
+	res, err := m.tables.Allocate(name, taken)
+	if err != nil {
+		m.logf("AllocateTable: %v, %d tables taken", err, len(taken))
+		return 0, fmt.Errorf("AllocateTable: %w", err)
+	}
+	m.logf("AllocateTable: allocated table %d for vrf %s, %d tables taken", res, name, len(taken))
+	return res, nil
+}
+
+// usedTables returns the routing tables that have routes or that an ip
+// rule points to, for both ipv4 and ipv6. Giving one of them to a VRF
+// would merge unrelated routing state into it.
+func usedTables(h Netlink) ([]uint32, error) {
+	res := make([]uint32, 0)
+	for _, family := range families {
+		routes, err := h.RouteListFiltered(family, &netlink.Route{Table: unix.RT_TABLE_UNSPEC}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return nil, fmt.Errorf("failed listing routes: %w", err)
+		}
+		for _, r := range routes {
+			// Routes are dumped table by table.
+			if n := len(res); n > 0 && res[n-1] == uint32(r.Table) {
+				continue
+			}
+			res = append(res, uint32(r.Table))
+		}
+
+		rules, err := h.RuleList(family)
+		if err != nil {
+			return nil, fmt.Errorf("failed listing rules: %w", err)
+		}
+		for _, r := range rules {
+			if r.Table > 0 {
+				res = append(res, uint32(r.Table))
+			}
+		}
+	}
+	return res, nil
+}
+
+// Attach enslaves the interface to the VRF. The ipv6 addresses and routes
+// the kernel flushes when the interface changes master are restored, and the
+// routes of the main table through the interface, ipv4 and ipv6, are moved to
+// the table of the VRF. The returned function puts the interface back out of
+// the VRF with the addresses and routes it had before. It is set as soon as
+// the interface is enslaved, so it is returned along with the errors that
+// happen after that.
+func (m *Manager) Attach(vrf *netlink.Vrf, ifName string) (func() error, error) {
+	intf, err := m.h.LinkByName(ifName)
+	if IsLinkNotFound(err) {
+		return nil, newError(ErrInterfaceNotFound, "link "+ifName, "interface %s not found: %v", ifName, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not get link by name %s: %w", ifName, err)
+	}
+
+	if intf.Attrs().MasterIndex != 0 {
+		master, err := m.h.LinkByIndex(intf.Attrs().MasterIndex)
+		if err != nil {
+			return nil, newError(ErrHasMaster, "link "+ifName, "interface %s has already a master set, could not retrieve the name: %v", ifName, err)
+		}
+		return nil, newError(ErrHasMaster, "link "+ifName, "interface %s has already a master set: %s", ifName, master.Attrs().Name)
+	}
+
+	ipv6, err := SaveIPv6State(m.h, intf)
+	if err != nil {
+		return nil, err
+	}
+	routes, err := mainIPv4Routes(m.h, intf)
+	if err != nil {
+		return nil, err
+	}
+
+	m.logf("Attach: setting vrf %s as master of %s", vrf.Name, ifName)
+	m.links = nil
+	err = m.h.LinkSetMaster(intf, vrf)
+	if err != nil {
+		return nil, fmt.Errorf("could not set vrf %s as master of %s: %w", vrf.Name, ifName, err)
+	}
+	undo := func() error {
+		err := m.Detach(vrf, ifName)
+		if err != nil {
+			return err
+		}
+		err = ipv6.Restore(intf, unix.RT_TABLE_MAIN, unix.RT_TABLE_MAIN)
+		if err != nil {
+			return err
+		}
+		return m.restoreRoutes(routes)
+	}
+
+	m.logf("Attach: restoring %d ipv6 addresses and %d ipv6 routes of %s", len(ipv6.addresses), len(ipv6.routes), ifName)
+	err = ipv6.Restore(intf, unix.RT_TABLE_MAIN, int(vrf.Table))
+	if err != nil {
+		return undo, err
+	}
+	m.logf("Attach: moving %d ipv4 routes of %s to vrf %s", len(routes), ifName, vrf.Name)
+	return undo, m.moveRoutes(routes, vrf)
+}
+
+// Detach removes the interface from the VRF, restoring its ipv6 addresses
+// and routes the same way Attach does. Interfaces that no longer exist or
+// that are not enslaved to the VRF are left untouched.
+func (m *Manager) Detach(vrf *netlink.Vrf, ifName string) error {
+	intf, err := m.h.LinkByName(ifName)
+	if IsLinkNotFound(err) {
+		m.logf("Detach: link %s not found", ifName)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Detach: could not get link by name %s: %w", ifName, err)
+	}
+	if intf.Attrs().MasterIndex != vrf.Index {
+		m.logf("Detach: %s is not enslaved to vrf %s", ifName, vrf.Name)
+		return nil
+	}
+
+	ipv6, err := SaveIPv6State(m.h, intf)
+	if err != nil {
+		return fmt.Errorf("Detach: %w", err)
+	}
+	m.logf("Detach: removing %s from vrf %s", ifName, vrf.Name)
+	m.links = nil
+	err = m.h.LinkSetNoMaster(intf)
+	if err != nil {
+		return fmt.Errorf("Detach: could not reset master of %s: %w", ifName, err)
+	}
+
+	m.logf("Detach: restoring %d ipv6 addresses and %d ipv6 routes of %s", len(ipv6.addresses), len(ipv6.routes), ifName)
+	err = ipv6.Restore(intf, int(vrf.Table), unix.RT_TABLE_MAIN)
+	if err != nil {
+		return fmt.Errorf("Detach: %w", err)
+	}
+	return nil
+}
+
+// mainIPv4Routes returns the ipv4 routes of the main table whose output
+// interface is the given one, excluding the ones installed by the kernel.
+// The ipv6 ones are part of the IPv6State.
+func mainIPv4Routes(h Netlink, intf netlink.Link) ([]netlink.Route, error) {
+	filter := &netlink.Route{
+		LinkIndex: intf.Attrs().Index,
+		Table:     unix.RT_TABLE_MAIN,
+	}
+	routes, err := h.RouteListFiltered(netlink.FAMILY_V4, filter, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, fmt.Errorf("failed getting routes for %s: %w", intf.Attrs().Name, err)
+	}
+
+	res := make([]netlink.Route, 0, len(routes))
+	for _, r := range routes {
+		// Connected routes are moved to the VRF table by the kernel.
+		if r.Protocol == unix.RTPROT_KERNEL {
+			continue
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+// moveRoutes installs the given routes in the routing table of the VRF, and
+// removes them from their original table if they are still there.
+func (m *Manager) moveRoutes(routes []netlink.Route, vrf *netlink.Vrf) error {
+	for _, r := range routes {
+		toAdd := r
+		toAdd.Table = int(vrf.Table)
+		// Flags such as linkdown are set by the kernel and can't be passed back.
+		toAdd.Flags &= unix.RTNH_F_ONLINK
+		err := m.h.RouteReplace(&toAdd)
+		if err != nil {
+			return fmt.Errorf("could not move route %s to VRF %s: %w", r, vrf.Name, err)
+		}
+
+		err = m.h.RouteDel(&r)
+		if err != nil && err != unix.ESRCH {
+			return fmt.Errorf("could not remove route %s from table %d: %w", r, r.Table, err)
+		}
+	}
+	return nil
+}
+
+// restoreRoutes installs back the given routes in their original table.
+func (m *Manager) restoreRoutes(routes []netlink.Route) error {
+	for _, r := range routes {
+		toAdd := r
+		toAdd.Flags &= unix.RTNH_F_ONLINK
+		err := m.h.RouteReplace(&toAdd)
+		if err != nil {
+			return fmt.Errorf("could not restore route %s: %w", r, err)
+		}
+	}
+	return nil
+}
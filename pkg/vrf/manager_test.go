@@ -0,0 +1,150 @@
+// Copyright 2020 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build privileged
+
+package vrf
+
+import (
+	"errors"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("manager", func() {
+	var targetNS ns.NetNS
+	const (
+		IF0Name  = "dummy0"
+		VRF0Name = "vrf0"
+		VRF1Name = "vrf1"
+	)
+
+	BeforeEach(func() {
+		var err error
+		targetNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			return netlink.LinkAdd(&netlink.Dummy{
+				LinkAttrs: netlink.LinkAttrs{
+					Name: IF0Name,
+				},
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(targetNS.Close()).To(Succeed())
+	})
+
+	It("creates a VRF only once", func() {
+		err := targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			m := NewManager(Kernel(), nil)
+			vrf, created, err := m.Ensure(VRF0Name, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(created).To(BeTrue())
+			Expect(vrf.Table).To(Equal(uint32(1)))
+
+			existing, created, err := m.Ensure(VRF0Name, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(created).To(BeFalse())
+			Expect(existing.Index).To(Equal(vrf.Index))
+
+			found, err := HasL3mdevRule(Kernel(), netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(found).To(BeTrue())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("fails on conflicting tables", func() {
+		err := targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			m := NewManager(Kernel(), nil)
+			_, _, err := m.Ensure(VRF0Name, 100)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, err = m.Ensure(VRF0Name, 101)
+			Expect(errors.Is(err, ErrTableConflict)).To(BeTrue())
+			_, _, err = m.Ensure(VRF1Name, 100)
+			Expect(errors.Is(err, ErrTableConflict)).To(BeTrue())
+			_, _, err = m.Ensure(VRF1Name, 254)
+			Expect(errors.Is(err, ErrReservedTable)).To(BeTrue())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("attaches and detaches interfaces keeping their ipv6 addresses", func() {
+		err := targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IF0Name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(link)).To(Succeed())
+			addr, err := netlink.ParseAddr("2001:db8::2/64")
+			Expect(err).NotTo(HaveOccurred())
+			addr.Flags = unix.IFA_F_NODAD
+			Expect(netlink.AddrAdd(link, addr)).To(Succeed())
+
+			m := NewManager(Kernel(), nil)
+			vrf, _, err := m.Ensure(VRF0Name, 0)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = m.Attach(vrf, IF0Name)
+			Expect(err).NotTo(HaveOccurred())
+			members, err := m.Members(vrf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(members).To(HaveLen(1))
+			Expect(members[0].Attrs().Name).To(Equal(IF0Name))
+
+			other, _, err := m.Ensure(VRF1Name, 0)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = m.Attach(other, IF0Name)
+			Expect(errors.Is(err, ErrHasMaster)).To(BeTrue())
+
+			Expect(m.Detach(vrf, IF0Name)).To(Succeed())
+			members, err = m.Members(vrf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(members).To(BeEmpty())
+
+			addrs, err := netlink.AddrList(link, netlink.FAMILY_V6)
+			Expect(err).NotTo(HaveOccurred())
+			found := false
+			for _, a := range addrs {
+				if a.IPNet.String() == addr.IPNet.String() {
+					found = true
+				}
+			}
+			Expect(found).To(BeTrue())
+
+			// Interfaces that are not members are left untouched.
+			Expect(m.Detach(vrf, IF0Name)).To(Succeed())
+			Expect(m.Detach(vrf, "missing")).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
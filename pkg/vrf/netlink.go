@@ -0,0 +1,133 @@
+// Copyright 2020 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vrf
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// Netlink is the subset of the netlink operations the VRFs are managed
+// with. Kernel talks to the kernel, and the vrftest package provides an
+// in-memory implementation for the tests that can't run as root.
+type Netlink interface {
+	LinkList() ([]netlink.Link, error)
+	LinkByName(name string) (netlink.Link, error)
+	LinkByIndex(index int) (netlink.Link, error)
+	LinkAdd(link netlink.Link) error
+	LinkDel(link netlink.Link) error
+	LinkSetUp(link netlink.Link) error
+	LinkSetMaster(link, master netlink.Link) error
+	LinkSetNoMaster(link netlink.Link) error
+
+	AddrList(link netlink.Link, family int) ([]netlink.Addr, error)
+	AddrAdd(link netlink.Link, addr *netlink.Addr) error
+
+	RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error)
+	RouteReplace(route *netlink.Route) error
+	RouteDel(route *netlink.Route) error
+
+	RuleList(family int) ([]netlink.Rule, error)
+	RuleListFiltered(family int, filter *netlink.Rule, filterMask uint64) ([]netlink.Rule, error)
+	RuleAdd(rule *netlink.Rule) error
+	RuleDel(rule *netlink.Rule) error
+
+	// L3mdevRulePriorities returns the preferences of the l3mdev rules of
+	// the given family.
+	L3mdevRulePriorities(family int) ([]int, error)
+	// AddL3mdevRule adds an l3mdev rule with the given preference.
+	AddL3mdevRule(family, priority int) error
+}
+
+// ErrLinkNotFound is what a Netlink other than Kernel returns when the
+// link does not exist, since netlink.LinkNotFoundError can't be built
+// outside of the netlink package.
+var ErrLinkNotFound = errors.New("link not found")
+
+// IsLinkNotFound tells if the error is returned by a Netlink because the
+// link does not exist.
+func IsLinkNotFound(err error) bool {
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return true
+	}
+	return errors.Is(err, ErrLinkNotFound)
+}
+
+// kernel implements Netlink in the netns of the calling thread.
+type kernel struct {
+	*netlink.Handle
+}
+
+// Kernel returns the Netlink talking to the kernel, in the netns of the
+// calling thread.
+func Kernel() Netlink {
+	return kernel{&netlink.Handle{}}
+}
+
+// L3mdevRulePriorities dumps the rules directly, since the netlink library
+// does not expose the l3mdev attribute.
+func (kernel) L3mdevRulePriorities(family int) ([]int, error) {
+	req := nl.NewNetlinkRequest(unix.RTM_GETRULE, unix.NLM_F_DUMP)
+	req.AddData(nl.NewIfInfomsg(family))
+
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWRULE)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing rules: %v", err)
+	}
+
+	res := make([]int, 0)
+	for _, m := range msgs {
+		msg := nl.DeserializeRtMsg(m)
+		attrs, err := nl.ParseRouteAttr(m[msg.Len():])
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing rule: %v", err)
+		}
+		l3mdev, priority := false, 0
+		for _, a := range attrs {
+			switch a.Attr.Type {
+			case nl.FRA_L3MDEV:
+				l3mdev = len(a.Value) > 0 && a.Value[0] == 1
+			case nl.FRA_PRIORITY:
+				priority = int(native.Uint32(a.Value))
+			}
+		}
+		if l3mdev {
+			res = append(res, priority)
+		}
+	}
+	return res, nil
+}
+
+// AddL3mdevRule is equivalent to ip rule add l3mdev pref <priority>.
+func (kernel) AddL3mdevRule(family, priority int) error {
+	req := nl.NewNetlinkRequest(unix.RTM_NEWRULE, unix.NLM_F_CREATE|unix.NLM_F_EXCL|unix.NLM_F_ACK)
+	msg := nl.NewRtMsg()
+	msg.Family = uint8(family)
+	msg.Table = unix.RT_TABLE_UNSPEC
+	msg.Type = unix.FR_ACT_TO_TBL
+	req.AddData(msg)
+	req.AddData(nl.NewRtAttr(nl.FRA_PRIORITY, nl.Uint32Attr(uint32(priority))))
+	req.AddData(nl.NewRtAttr(nl.FRA_L3MDEV, []byte{1}))
+
+	_, err := req.Execute(unix.NETLINK_ROUTE, 0)
+	if err != nil && err != unix.EEXIST {
+		return fmt.Errorf("could not add l3mdev rule: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2020 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vrf
+
+import (
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// l3mdevRulePriority is the preference the kernel uses for the l3mdev rule
+// it installs when the first VRF is created.
+const l3mdevRulePriority = 1000
+
+var (
+	native   = nl.NativeEndian()
+	families = []int{netlink.FAMILY_V4, netlink.FAMILY_V6}
+)
+
+// HasL3mdevRule tells if an l3mdev rule exists for the given family.
+func HasL3mdevRule(h Netlink, family int) (bool, error) {
+	priorities, err := h.L3mdevRulePriorities(family)
+	if err != nil {
+		return false, err
+	}
+	return len(priorities) > 0, nil
+}
+
+// ensureL3mdevRules adds the l3mdev rule for both ipv4 and ipv6,
+// unless it is already there.
+func ensureL3mdevRules(h Netlink) error {
+	for _, family := range families {
+		found, err := HasL3mdevRule(h, family)
+		if err != nil {
+			return err
+		}
+		if found {
+			continue
+		}
+		err = h.AddL3mdevRule(family, l3mdevRulePriority)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+// Copyright 2020 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vrf
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+
+	"golang.org/x/sys/unix"
+)
+
+// reservedTables are the routing tables that are never given to a VRF:
+// unspec, default, main and local.
+var reservedTables = []uint32{
+	unix.RT_TABLE_UNSPEC,
+	unix.RT_TABLE_DEFAULT,
+	unix.RT_TABLE_MAIN,
+	unix.RT_TABLE_LOCAL,
+}
+
+const (
+	// AllocationSequential gives a new VRF the first free table of the range.
+	AllocationSequential = "sequential"
+	// AllocationHash gives a new VRF a table derived from a hash of its name,
+	// probing the next ones on collision, so that a VRF gets the same table
+	// regardless of the order VRFs are created in.
+	AllocationHash = "hash"
+)
+
+// TableRange is the range, bounds included, the routing table of a new VRF
+// is allocated from.
+type TableRange struct {
+	Min uint32 `json:"min"`
+	Max uint32 `json:"max"`
+}
+
+// TablePolicy tells which routing tables can be given to a VRF.
+type TablePolicy struct {
+	min, max uint32
+	denied   map[uint32]struct{}
+	// deniedSet holds the denied tables sorted once, for Allocate.
+	deniedSet tableSet
+	hashed    bool
+}
+
+// NewTablePolicy returns the policy for the given range, deny list and
+// allocation mode. With no range, tables are allocated starting from 1.
+func NewTablePolicy(tableRange *TableRange, denyTables []uint32, allocation string) (*TablePolicy, error) {
+	p := &TablePolicy{
+		min:    1,
+		max:    math.MaxUint32 - 1,
+		denied: make(map[uint32]struct{}, len(reservedTables)+len(denyTables)),
+	}
+	switch allocation {
+	case "", AllocationSequential:
+	case AllocationHash:
+		p.hashed = true
+	default:
+		return nil, fmt.Errorf("invalid tableAllocation %s", allocation)
+	}
+	if tableRange != nil {
+		if tableRange.Min == 0 || tableRange.Max < tableRange.Min {
+			return nil, fmt.Errorf("invalid tableRange %d-%d", tableRange.Min, tableRange.Max)
+		}
+		p.min, p.max = tableRange.Min, tableRange.Max
+	}
+	for _, t := range reservedTables {
+		p.denied[t] = struct{}{}
+	}
+	for _, t := range denyTables {
+		p.denied[t] = struct{}{}
+	}
+	denied := make([]uint32, 0, len(p.denied))
+	for t := range p.denied {
+		denied = append(denied, t)
+	}
+	p.deniedSet = newTableSet(denied)
+	return p, nil
+}
+
+// Validate checks that the given table can be used by a VRF. Tables set
+// explicitly do not need to be in the allocation range.
+func (p *TablePolicy) Validate(table uint32) error {
+	if _, ok := p.denied[table]; ok {
+		return newError(ErrReservedTable, fmt.Sprintf("table %d", table), "routing table %d is reserved", table)
+	}
+	return nil
+}
+
+// Allocate returns a table of the range for the VRF with the given name
+// that is neither denied nor taken. The search starts from the beginning
+// of the range, or from the hash of the name in hash mode, and wraps around.
+func (p *TablePolicy) Allocate(name string, taken []uint32) (uint32, error) {
+	start := p.min
+	if p.hashed {
+		h := fnv.New32a()
+		h.Write([]byte(name))
+		start = p.min + uint32(uint64(h.Sum32())%(uint64(p.max-p.min)+1))
+	}
+
+	// The taken tables are copied, as sorting them in place would change
+	// the slice of the caller.
+	sets := []tableSet{p.deniedSet, newTableSet(append([]uint32(nil), taken...))}
+
+	if t, ok := nextFree(start, p.max, sets); ok {
+		return t, nil
+	}
+	if start > p.min {
+		if t, ok := nextFree(p.min, start-1, sets); ok {
+			return t, nil
+		}
+	}
+	return 0, newError(ErrNoTableAvailable, fmt.Sprintf("tables %d-%d", p.min, p.max), "no routing table available in range %d-%d", p.min, p.max)
+}
+
+// tableSet is a sorted set of routing tables.
+type tableSet []uint32
+
+func newTableSet(tables []uint32) tableSet {
+	sort.Slice(tables, func(i, j int) bool { return tables[i] < tables[j] })
+	res := tables[:0]
+	for _, t := range tables {
+		if n := len(res); n > 0 && res[n-1] == t {
+			continue
+		}
+		res = append(res, t)
+	}
+	return res
+}
+
+// nextFree returns the first table between from and to, bounds included,
+// that is not in the set. The tables of the set being sorted and unique,
+// the contiguous block of tables starting from from is found with a binary
+// search rather than by walking it.
+func (s tableSet) nextFree(from, to uint32) (uint32, bool) {
+	i0 := sort.Search(len(s), func(i int) bool { return s[i] >= from })
+	// The block is made of the tables s[i] equal to from+(i-i0), the first
+	// one that is not tells where the block ends.
+	i := i0 + sort.Search(len(s)-i0, func(i int) bool { return uint64(s[i0+i]) != uint64(from)+uint64(i) })
+	t := uint64(from) + uint64(i-i0)
+	if t > uint64(to) {
+		return 0, false
+	}
+	return uint32(t), true
+}
+
+// nextFree returns the first table between from and to, bounds included,
+// that is in none of the given sets.
+func nextFree(from, to uint32, sets []tableSet) (uint32, bool) {
+	t := from
+	for {
+		moved := false
+		for _, s := range sets {
+			next, ok := s.nextFree(t, to)
+			if !ok {
+				return 0, false
+			}
+			if next != t {
+				t, moved = next, true
+			}
+		}
+		if !moved {
+			return t, true
+		}
+	}
+}
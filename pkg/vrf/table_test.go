@@ -0,0 +1,100 @@
+// Copyright 2020 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vrf
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("table policy", func() {
+	DescribeTable("rejects invalid policies",
+		func(tableRange *TableRange, allocation string, expected string) {
+			_, err := NewTablePolicy(tableRange, nil, allocation)
+			Expect(err).To(MatchError(expected))
+		},
+		Entry("an empty range", &TableRange{Min: 20, Max: 10}, AllocationSequential, "invalid tableRange 20-10"),
+		Entry("a range starting from 0", &TableRange{Min: 0, Max: 10}, AllocationSequential, "invalid tableRange 0-10"),
+		Entry("an unknown allocation mode", nil, "random", "invalid tableAllocation random"),
+	)
+
+	It("rejects the reserved and denied tables", func() {
+		tables, err := NewTablePolicy(nil, []uint32{100}, AllocationSequential)
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, t := range []uint32{0, 100, 253, 254, 255} {
+			err := tables.Validate(t)
+			Expect(err).To(HaveOccurred())
+			Expect(errors.Is(err, ErrReservedTable)).To(BeTrue())
+		}
+		Expect(tables.Validate(101)).To(Succeed())
+	})
+
+	It("allocates the first free table of the range", func() {
+		tables, err := NewTablePolicy(&TableRange{Min: 250, Max: 260}, []uint32{252}, AllocationSequential)
+		Expect(err).NotTo(HaveOccurred())
+
+		res, err := tables.Allocate("vrf0", []uint32{250, 251})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(Equal(uint32(256)))
+	})
+
+	It("probes the next tables on hash collisions", func() {
+		tables, err := NewTablePolicy(&TableRange{Min: 10000, Max: 10001}, nil, AllocationHash)
+		Expect(err).NotTo(HaveOccurred())
+
+		first, err := tables.Allocate("vrf0", nil)
+		Expect(err).NotTo(HaveOccurred())
+		second, err := tables.Allocate("vrf0", []uint32{first})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(second).NotTo(Equal(first))
+		Expect(second).To(BeNumerically(">=", 10000))
+		Expect(second).To(BeNumerically("<=", 10001))
+
+		_, err = tables.Allocate("vrf0", []uint32{10000, 10001})
+		Expect(err).To(MatchError("no routing table available in range 10000-10001"))
+	})
+
+	DescribeTable("finds the free tables of a table set",
+		func(tables []uint32, from, to uint32, expected uint32, found bool) {
+			res, ok := newTableSet(tables).nextFree(from, to)
+			Expect(ok).To(Equal(found))
+			if found {
+				Expect(res).To(Equal(expected))
+			}
+		},
+		Entry("an empty set", nil, uint32(1), uint32(10), uint32(1), true),
+		Entry("a gap after the first tables", []uint32{3, 1, 2, 2, 5}, uint32(1), uint32(10), uint32(4), true),
+		Entry("tables before the start", []uint32{1, 2, 3}, uint32(5), uint32(10), uint32(5), true),
+		Entry("a full range", []uint32{5, 6, 7}, uint32(5), uint32(7), uint32(0), false),
+		Entry("the last table of the range", []uint32{5, 6}, uint32(5), uint32(7), uint32(7), true),
+		Entry("a gap after a long block", []uint32{5, 6, 7, 8, 9, 10, 12}, uint32(5), uint32(20), uint32(11), true),
+		Entry("a block up to the last table", []uint32{4294967293, 4294967294, 4294967295}, uint32(4294967293), uint32(4294967295), uint32(0), false),
+	)
+
+	It("skips the denied and taken tables when they interleave", func() {
+		tables, err := NewTablePolicy(&TableRange{Min: 10, Max: 20}, []uint32{11, 13}, AllocationSequential)
+		Expect(err).NotTo(HaveOccurred())
+
+		taken := []uint32{14, 12, 10}
+		res, err := tables.Allocate("vrf0", taken)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(Equal(uint32(15)))
+		Expect(taken).To(Equal([]uint32{14, 12, 10}))
+	})
+})
@@ -0,0 +1,109 @@
+// Copyright 2020 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package vrf manages the VRFs of the current netns: it looks them up,
+// creates them allocating their routing tables, and moves interfaces in
+// and out of them. It is what the vrf CNI plugin and vrfctl are built on.
+package vrf
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/vishvananda/netlink"
+)
+
+// FindVRF finds a VRF link with the provided name. IsLinkNotFound tells
+// if there is no link with that name.
+func FindVRF(h Netlink, name string) (*netlink.Vrf, error) {
+	link, err := h.LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+	vrf, ok := link.(*netlink.Vrf)
+	if !ok {
+		return nil, fmt.Errorf("Netlink %s is not a VRF", name)
+	}
+	return vrf, nil
+}
+
+// Snapshot holds the links of the netns, taken with a single dump and
+// indexed for the lookups on VRFs and their members.
+type Snapshot struct {
+	links   map[int]netlink.Link
+	vrfs    map[string]*netlink.Vrf
+	tables  map[uint32]*netlink.Vrf
+	members map[int][]netlink.Link
+}
+
+// TakeSnapshot dumps the links of the netns the given Netlink works on.
+func TakeSnapshot(h Netlink) (*Snapshot, error) {
+	links, err := h.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find links %w", err)
+	}
+	res := &Snapshot{
+		links:   make(map[int]netlink.Link, len(links)),
+		vrfs:    make(map[string]*netlink.Vrf),
+		tables:  make(map[uint32]*netlink.Vrf),
+		members: make(map[int][]netlink.Link),
+	}
+	for _, l := range links {
+		res.links[l.Attrs().Index] = l
+		if vrf, ok := l.(*netlink.Vrf); ok {
+			res.vrfs[vrf.Name] = vrf
+			res.tables[vrf.Table] = vrf
+		}
+		if master := l.Attrs().MasterIndex; master != 0 {
+			res.members[master] = append(res.members[master], l)
+		}
+	}
+	return res, nil
+}
+
+// LinkByIndex returns the link with the given index.
+func (s *Snapshot) LinkByIndex(index int) (netlink.Link, bool) {
+	l, ok := s.links[index]
+	return l, ok
+}
+
+// VRFs returns the VRFs of the netns, sorted by name.
+func (s *Snapshot) VRFs() []*netlink.Vrf {
+	res := make([]*netlink.Vrf, 0, len(s.vrfs))
+	for _, vrf := range s.vrfs {
+		res = append(res, vrf)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// VRFForTable returns the VRF using the given routing table.
+func (s *Snapshot) VRFForTable(tableID uint32) (*netlink.Vrf, bool) {
+	vrf, ok := s.tables[tableID]
+	return vrf, ok
+}
+
+// Tables returns the routing tables used by the VRFs.
+func (s *Snapshot) Tables() []uint32 {
+	res := make([]uint32, 0, len(s.tables))
+	for t := range s.tables {
+		res = append(res, t)
+	}
+	return res
+}
+
+// AssignedInterfaces returns the list of interfaces associated to the given vrf.
+func (s *Snapshot) AssignedInterfaces(vrf *netlink.Vrf) []netlink.Link {
+	return s.members[vrf.Index]
+}
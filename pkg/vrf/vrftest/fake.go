@@ -0,0 +1,687 @@
+// Copyright 2020 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package vrftest provides an in-memory vrf.Netlink, to test the code that
+// manages VRFs without privileges.
+package vrftest
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/fedepaol/vrfcni/pkg/vrf"
+)
+
+var _ vrf.Netlink = (*Fake)(nil)
+
+// Fake is an in-memory netns. It models the parts of the kernel behaviour
+// the VRFs depend on:
+//   - an interface has at most one master, which must be a VRF, and is
+//     released when its master is deleted;
+//   - when an interface changes master, the routes through it are flushed
+//     and so are its ipv6 addresses, unless KeepAddrOnDown is set. The
+//     connected routes of the remaining addresses are added to the table
+//     of the new master;
+//   - two VRFs can't share a routing table, as with net.vrf.strict_mode=1;
+//   - the l3mdev rules are added when the first VRF is created.
+//
+// Failures are reported with the errno the kernel would return.
+type Fake struct {
+	// KeepAddrOnDown mimics net.ipv6.conf.all.keep_addr_on_down=1.
+	KeepAddrOnDown bool
+	// Errors makes the operations with the given name, such as
+	// "LinkSetMaster", fail with the given error.
+	Errors map[string]error
+
+	links     map[int]netlink.Link
+	nextIndex int
+	addrs     map[int][]netlink.Addr
+	routes    []netlink.Route
+	rules     []rule
+	vrfRules  bool
+}
+
+type rule struct {
+	netlink.Rule
+	l3mdev bool
+}
+
+// NewFake returns a netns holding the loopback interface and the default
+// ip rules.
+func NewFake() *Fake {
+	f := &Fake{
+		Errors:    make(map[string]error),
+		links:     make(map[int]netlink.Link),
+		nextIndex: 1,
+		addrs:     make(map[int][]netlink.Addr),
+	}
+	lo := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "lo"}}
+	f.LinkAdd(lo)
+	f.LinkSetUp(lo)
+
+	defaults := []struct {
+		family, table, priority int
+	}{
+		{netlink.FAMILY_V4, unix.RT_TABLE_LOCAL, 0},
+		{netlink.FAMILY_V4, unix.RT_TABLE_MAIN, 32766},
+		{netlink.FAMILY_V4, unix.RT_TABLE_DEFAULT, 32767},
+		{netlink.FAMILY_V6, unix.RT_TABLE_LOCAL, 0},
+		{netlink.FAMILY_V6, unix.RT_TABLE_MAIN, 32766},
+	}
+	for _, d := range defaults {
+		r := netlink.NewRule()
+		r.Family = d.family
+		r.Table = d.table
+		r.Priority = d.priority
+		f.rules = append(f.rules, rule{Rule: *r})
+	}
+	return f
+}
+
+func (f *Fake) fail(op string) error {
+	return f.Errors[op]
+}
+
+// copyLink returns a copy of the link, so that the callers can't change
+// the state of the fake.
+func copyLink(l netlink.Link) netlink.Link {
+	switch l := l.(type) {
+	case *netlink.Vrf:
+		c := *l
+		return &c
+	case *netlink.Dummy:
+		c := *l
+		return &c
+	case *netlink.Veth:
+		c := *l
+		return &c
+	}
+	return &netlink.Device{LinkAttrs: *l.Attrs()}
+}
+
+// lookup returns the stored link the given one refers to, by index or
+// by name.
+func (f *Fake) lookup(l netlink.Link) (netlink.Link, error) {
+	if l == nil {
+		return nil, unix.ENODEV
+	}
+	if i := l.Attrs().Index; i != 0 {
+		if res, ok := f.links[i]; ok {
+			return res, nil
+		}
+		return nil, unix.ENODEV
+	}
+	for _, res := range f.links {
+		if res.Attrs().Name == l.Attrs().Name {
+			return res, nil
+		}
+	}
+	return nil, unix.ENODEV
+}
+
+func (f *Fake) LinkList() ([]netlink.Link, error) {
+	if err := f.fail("LinkList"); err != nil {
+		return nil, err
+	}
+	indexes := make([]int, 0, len(f.links))
+	for i := range f.links {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	res := make([]netlink.Link, 0, len(indexes))
+	for _, i := range indexes {
+		res = append(res, copyLink(f.links[i]))
+	}
+	return res, nil
+}
+
+func (f *Fake) LinkByName(name string) (netlink.Link, error) {
+	if err := f.fail("LinkByName"); err != nil {
+		return nil, err
+	}
+	for _, l := range f.links {
+		if l.Attrs().Name == name {
+			return copyLink(l), nil
+		}
+	}
+	return nil, fmt.Errorf("Link %s not found: %w", name, vrf.ErrLinkNotFound)
+}
+
+func (f *Fake) LinkByIndex(index int) (netlink.Link, error) {
+	if err := f.fail("LinkByIndex"); err != nil {
+		return nil, err
+	}
+	l, ok := f.links[index]
+	if !ok {
+		return nil, fmt.Errorf("Link %d not found: %w", index, vrf.ErrLinkNotFound)
+	}
+	return copyLink(l), nil
+}
+
+// LinkAdd adds the link, setting its index. Links other than the loopback
+// get a locally administered mac address when they have none.
+func (f *Fake) LinkAdd(link netlink.Link) error {
+	if err := f.fail("LinkAdd"); err != nil {
+		return err
+	}
+	attrs := link.Attrs()
+	if attrs.Name == "" {
+		return unix.EINVAL
+	}
+	for _, l := range f.links {
+		if l.Attrs().Name == attrs.Name {
+			return unix.EEXIST
+		}
+	}
+	v, isVRF := link.(*netlink.Vrf)
+	if isVRF {
+		if v.Table == 0 {
+			return unix.EINVAL
+		}
+		for _, l := range f.links {
+			if other, ok := l.(*netlink.Vrf); ok && other.Table == v.Table {
+				return unix.EBUSY
+			}
+		}
+	}
+	master := attrs.MasterIndex
+	if master != 0 {
+		if _, ok := f.links[master].(*netlink.Vrf); !ok {
+			return unix.EINVAL
+		}
+	}
+
+	attrs.Index = f.nextIndex
+	f.nextIndex++
+	stored := copyLink(link)
+	if len(stored.Attrs().HardwareAddr) == 0 && attrs.Index != 1 {
+		stored.Attrs().HardwareAddr = net.HardwareAddr{0x02, 0, 0, 0, byte(attrs.Index >> 8), byte(attrs.Index)}
+	}
+	stored.Attrs().OperState = netlink.OperDown
+	if stored.Attrs().Flags&net.FlagUp != 0 {
+		stored.Attrs().OperState = netlink.OperUp
+	}
+	f.links[attrs.Index] = stored
+
+	if isVRF && !f.vrfRules {
+		f.vrfRules = true
+		for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+			f.addL3mdevRule(family, 1000)
+		}
+	}
+	return nil
+}
+
+// LinkDel deletes the link, with its addresses and the routes through it.
+// The members of a VRF are released.
+func (f *Fake) LinkDel(link netlink.Link) error {
+	if err := f.fail("LinkDel"); err != nil {
+		return err
+	}
+	l, err := f.lookup(link)
+	if err != nil {
+		return err
+	}
+	index := l.Attrs().Index
+	for _, member := range f.links {
+		if member.Attrs().MasterIndex == index {
+			f.setMaster(member, 0)
+		}
+	}
+	f.flushRoutes(index)
+	delete(f.addrs, index)
+	delete(f.links, index)
+	return nil
+}
+
+func (f *Fake) LinkSetUp(link netlink.Link) error {
+	if err := f.fail("LinkSetUp"); err != nil {
+		return err
+	}
+	l, err := f.lookup(link)
+	if err != nil {
+		return err
+	}
+	l.Attrs().Flags |= net.FlagUp
+	l.Attrs().OperState = netlink.OperUp
+	return nil
+}
+
+func (f *Fake) LinkSetMaster(link, master netlink.Link) error {
+	if err := f.fail("LinkSetMaster"); err != nil {
+		return err
+	}
+	l, err := f.lookup(link)
+	if err != nil {
+		return err
+	}
+	if master == nil {
+		f.setMaster(l, 0)
+		return nil
+	}
+	m, err := f.lookup(master)
+	if err != nil {
+		return err
+	}
+	if _, ok := m.(*netlink.Vrf); !ok {
+		return unix.EOPNOTSUPP
+	}
+	if m.Attrs().Index == l.Attrs().Index {
+		return unix.ELOOP
+	}
+	f.setMaster(l, m.Attrs().Index)
+	return nil
+}
+
+func (f *Fake) LinkSetNoMaster(link netlink.Link) error {
+	if err := f.fail("LinkSetNoMaster"); err != nil {
+		return err
+	}
+	l, err := f.lookup(link)
+	if err != nil {
+		return err
+	}
+	f.setMaster(l, 0)
+	return nil
+}
+
+// setMaster changes the master of the link, cycling it the way the kernel
+// does.
+func (f *Fake) setMaster(l netlink.Link, master int) {
+	attrs := l.Attrs()
+	if attrs.MasterIndex == master {
+		return
+	}
+	attrs.MasterIndex = master
+
+	f.flushRoutes(attrs.Index)
+	kept := make([]netlink.Addr, 0, len(f.addrs[attrs.Index]))
+	for _, a := range f.addrs[attrs.Index] {
+		if a.IP.To4() == nil && !f.KeepAddrOnDown {
+			continue
+		}
+		kept = append(kept, a)
+	}
+	f.addrs[attrs.Index] = kept
+	for _, a := range kept {
+		f.addConnectedRoute(attrs.Index, a)
+	}
+}
+
+// table returns the routing table of the connected routes of the link.
+func (f *Fake) table(index int) int {
+	if v, ok := f.links[f.links[index].Attrs().MasterIndex].(*netlink.Vrf); ok {
+		return int(v.Table)
+	}
+	return unix.RT_TABLE_MAIN
+}
+
+func (f *Fake) flushRoutes(index int) {
+	kept := f.routes[:0]
+	for _, r := range f.routes {
+		if r.LinkIndex != index {
+			kept = append(kept, r)
+		}
+	}
+	f.routes = kept
+}
+
+func (f *Fake) addConnectedRoute(index int, a netlink.Addr) {
+	ones, bits := a.Mask.Size()
+	if ones == bits || a.Flags&unix.IFA_F_NOPREFIXROUTE != 0 {
+		return
+	}
+	r := netlink.Route{
+		LinkIndex: index,
+		Dst:       &net.IPNet{IP: a.IP.Mask(a.Mask), Mask: a.Mask},
+		Protocol:  unix.RTPROT_KERNEL,
+		Scope:     netlink.SCOPE_LINK,
+		Table:     f.table(index),
+	}
+	if a.IP.To4() != nil {
+		r.Src = a.IP
+	} else {
+		r.Priority = 256
+	}
+	f.routes = append(f.routes, r)
+}
+
+// AddrList returns the addresses of the link, or of all the links if it's nil.
+func (f *Fake) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	if err := f.fail("AddrList"); err != nil {
+		return nil, err
+	}
+	indexes := make([]int, 0)
+	if link == nil {
+		for i := range f.addrs {
+			indexes = append(indexes, i)
+		}
+		sort.Ints(indexes)
+	} else {
+		l, err := f.lookup(link)
+		if err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, l.Attrs().Index)
+	}
+
+	res := make([]netlink.Addr, 0)
+	for _, i := range indexes {
+		for _, a := range f.addrs[i] {
+			if family == netlink.FAMILY_ALL || family == addrFamily(a.IP) {
+				res = append(res, a)
+			}
+		}
+	}
+	return res, nil
+}
+
+// AddrAdd adds the address to the link, along with its connected route.
+// The ipv6 addresses go through DAD instantly.
+func (f *Fake) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	if err := f.fail("AddrAdd"); err != nil {
+		return err
+	}
+	l, err := f.lookup(link)
+	if err != nil {
+		return err
+	}
+	index := l.Attrs().Index
+	for _, a := range f.addrs[index] {
+		if a.Equal(*addr) {
+			return unix.EEXIST
+		}
+	}
+	a := *addr
+	a.LinkIndex = index
+	a.Flags &^= unix.IFA_F_TENTATIVE | unix.IFA_F_OPTIMISTIC
+	f.addrs[index] = append(f.addrs[index], a)
+	f.addConnectedRoute(index, a)
+	return nil
+}
+
+func addrFamily(ip net.IP) int {
+	if ip.To4() != nil {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
+
+func routeFamily(r *netlink.Route) int {
+	switch {
+	case r.Family != 0:
+		return r.Family
+	case r.Dst != nil:
+		return addrFamily(r.Dst.IP)
+	case r.Gw != nil:
+		return addrFamily(r.Gw)
+	case r.Src != nil:
+		return addrFamily(r.Src)
+	}
+	return netlink.FAMILY_V4
+}
+
+func routeTable(r *netlink.Route) int {
+	if r.Table == unix.RT_TABLE_UNSPEC {
+		return unix.RT_TABLE_MAIN
+	}
+	return r.Table
+}
+
+// sameRoute tells if the routes have the same key, the one replace works on.
+func sameRoute(a, b *netlink.Route) bool {
+	return routeFamily(a) == routeFamily(b) &&
+		routeTable(a) == routeTable(b) &&
+		a.Dst.String() == b.Dst.String() &&
+		a.Priority == b.Priority &&
+		a.Tos == b.Tos
+}
+
+// RouteListFiltered filters the routes the same way the netlink library
+// does: only the main table is listed unless the table is filtered on, 0
+// standing for all the tables.
+func (f *Fake) RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error) {
+	if err := f.fail("RouteListFiltered"); err != nil {
+		return nil, err
+	}
+	res := make([]netlink.Route, 0)
+	for _, r := range f.routes {
+		if family != netlink.FAMILY_ALL && routeFamily(&r) != family {
+			continue
+		}
+		if r.Table != unix.RT_TABLE_MAIN && (filter == nil || filterMask&netlink.RT_FILTER_TABLE == 0) {
+			continue
+		}
+		if filter != nil {
+			switch {
+			case filterMask&netlink.RT_FILTER_TABLE != 0 && filter.Table != unix.RT_TABLE_UNSPEC && r.Table != filter.Table:
+				continue
+			case filterMask&netlink.RT_FILTER_OIF != 0 && r.LinkIndex != filter.LinkIndex:
+				continue
+			case filterMask&netlink.RT_FILTER_PROTOCOL != 0 && r.Protocol != filter.Protocol:
+				continue
+			case filterMask&netlink.RT_FILTER_TYPE != 0 && r.Type != filter.Type:
+				continue
+			case filterMask&netlink.RT_FILTER_GW != 0 && !r.Gw.Equal(filter.Gw):
+				continue
+			case filterMask&netlink.RT_FILTER_DST != 0 && r.Dst.String() != filter.Dst.String():
+				continue
+			}
+		}
+		res = append(res, r)
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Table < res[j].Table })
+	return res, nil
+}
+
+// RouteReplace adds the route, replacing the one with the same key. The
+// gateway must be reachable through a connected route of the same table,
+// unless the route is onlink. The ipv6 routes without a metric get 1024.
+func (f *Fake) RouteReplace(route *netlink.Route) error {
+	if err := f.fail("RouteReplace"); err != nil {
+		return err
+	}
+	r := *route
+	r.Table = routeTable(route)
+	if r.Priority == 0 && routeFamily(&r) == netlink.FAMILY_V6 {
+		r.Priority = 1024
+	}
+	if r.Type == 0 {
+		r.Type = unix.RTN_UNICAST
+	}
+	if r.LinkIndex != 0 {
+		if _, ok := f.links[r.LinkIndex]; !ok {
+			return unix.ENODEV
+		}
+	}
+	if r.Gw != nil && r.Flags&unix.RTNH_F_ONLINK == 0 {
+		dev, ok := f.nextHop(&r)
+		if !ok {
+			return unix.ENETUNREACH
+		}
+		r.LinkIndex = dev
+	}
+
+	for i := range f.routes {
+		if sameRoute(&f.routes[i], &r) {
+			f.routes[i] = r
+			return nil
+		}
+	}
+	f.routes = append(f.routes, r)
+	return nil
+}
+
+// nextHop returns the interface of the connected route the gateway of the
+// route is reachable through.
+func (f *Fake) nextHop(r *netlink.Route) (int, bool) {
+	for _, c := range f.routes {
+		if c.Table != r.Table || c.Protocol != unix.RTPROT_KERNEL || c.Dst == nil {
+			continue
+		}
+		if r.LinkIndex != 0 && c.LinkIndex != r.LinkIndex {
+			continue
+		}
+		if c.Dst.Contains(r.Gw) {
+			return c.LinkIndex, true
+		}
+	}
+	return 0, false
+}
+
+// RouteDel deletes the route with the same key, checking the gateway, the
+// output interface and the metric when they are set.
+func (f *Fake) RouteDel(route *netlink.Route) error {
+	if err := f.fail("RouteDel"); err != nil {
+		return err
+	}
+	for i := range f.routes {
+		r := &f.routes[i]
+		key := *route
+		key.Priority = r.Priority
+		if !sameRoute(r, &key) || route.Priority != 0 && r.Priority != route.Priority {
+			continue
+		}
+		if route.LinkIndex != 0 && r.LinkIndex != route.LinkIndex {
+			continue
+		}
+		if route.Gw != nil && !r.Gw.Equal(route.Gw) {
+			continue
+		}
+		f.routes = append(f.routes[:i], f.routes[i+1:]...)
+		return nil
+	}
+	return unix.ESRCH
+}
+
+// RuleList returns the rules of the family, the l3mdev ones included. As
+// with the kernel, a preference of 0 is not reported.
+func (f *Fake) RuleList(family int) ([]netlink.Rule, error) {
+	return f.RuleListFiltered(family, nil, 0)
+}
+
+func (f *Fake) RuleListFiltered(family int, filter *netlink.Rule, filterMask uint64) ([]netlink.Rule, error) {
+	if err := f.fail("RuleList"); err != nil {
+		return nil, err
+	}
+	res := make([]netlink.Rule, 0)
+	for _, r := range f.rules {
+		if family != netlink.FAMILY_ALL && r.Family != family {
+			continue
+		}
+		if filter != nil {
+			switch {
+			case filterMask&netlink.RT_FILTER_TABLE != 0 && filter.Table != unix.RT_TABLE_UNSPEC && r.Table != filter.Table:
+				continue
+			case filterMask&netlink.RT_FILTER_PRIORITY != 0 && r.Priority != filter.Priority:
+				continue
+			}
+		}
+		res = append(res, r.Rule)
+		if r.Priority == 0 {
+			res[len(res)-1].Priority = -1
+		}
+	}
+	return res, nil
+}
+
+// RuleAdd adds the rule, failing if the same one exists.
+func (f *Fake) RuleAdd(r *netlink.Rule) error {
+	if err := f.fail("RuleAdd"); err != nil {
+		return err
+	}
+	toAdd := *r
+	if toAdd.Priority < 0 {
+		toAdd.Priority = 0
+	}
+	for _, existing := range f.rules {
+		if !existing.l3mdev && existing.Family == toAdd.Family && existing.Table == toAdd.Table && existing.Priority == toAdd.Priority {
+			return unix.EEXIST
+		}
+	}
+	f.rules = append(f.rules, rule{Rule: toAdd})
+	sort.SliceStable(f.rules, func(i, j int) bool { return f.rules[i].Priority < f.rules[j].Priority })
+	return nil
+}
+
+// RuleDel deletes the first rule of the family matching the table and
+// the preference, when they are set.
+func (f *Fake) RuleDel(r *netlink.Rule) error {
+	if err := f.fail("RuleDel"); err != nil {
+		return err
+	}
+	for i, existing := range f.rules {
+		if existing.l3mdev || existing.Family != r.Family {
+			continue
+		}
+		if r.Table > 0 && existing.Table != r.Table {
+			continue
+		}
+		if r.Priority >= 0 && existing.Priority != r.Priority {
+			continue
+		}
+		f.rules = append(f.rules[:i], f.rules[i+1:]...)
+		return nil
+	}
+	return unix.ENOENT
+}
+
+func (f *Fake) L3mdevRulePriorities(family int) ([]int, error) {
+	if err := f.fail("L3mdevRulePriorities"); err != nil {
+		return nil, err
+	}
+	res := make([]int, 0)
+	for _, r := range f.rules {
+		if r.l3mdev && r.Family == family {
+			res = append(res, r.Priority)
+		}
+	}
+	return res, nil
+}
+
+func (f *Fake) AddL3mdevRule(family, priority int) error {
+	if err := f.fail("AddL3mdevRule"); err != nil {
+		return err
+	}
+	f.addL3mdevRule(family, priority)
+	return nil
+}
+
+func (f *Fake) addL3mdevRule(family, priority int) {
+	for _, r := range f.rules {
+		if r.l3mdev && r.Family == family && r.Priority == priority {
+			return
+		}
+	}
+	r := netlink.NewRule()
+	r.Family = family
+	r.Priority = priority
+	f.rules = append(f.rules, rule{Rule: *r, l3mdev: true})
+	sort.SliceStable(f.rules, func(i, j int) bool { return f.rules[i].Priority < f.rules[j].Priority })
+}
+
+// DelL3mdevRules deletes the l3mdev rules, as ip rule del l3mdev does.
+func (f *Fake) DelL3mdevRules() {
+	kept := f.rules[:0]
+	for _, r := range f.rules {
+		if !r.l3mdev {
+			kept = append(kept, r)
+		}
+	}
+	f.rules = kept
+}
@@ -0,0 +1,130 @@
+// Copyright 2020 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// localRulePriority is where the local table rule is moved to, after the
+// l3mdev rule and before the main table one.
+const localRulePriority = 32765
+
+var ruleFamilies = []int{netlink.FAMILY_V4, netlink.FAMILY_V6}
+
+// moveLocalRules moves the local table rule from preference 0 to
+// localRulePriority for both ipv4 and ipv6, so that it is evaluated after the
+// l3mdev one and local addresses do not shadow the lookups in the VRF tables.
+// It returns true if any rule was changed.
+func moveLocalRules() (bool, error) {
+	changed := false
+	for _, family := range ruleFamilies {
+		original, moved, err := localRules(family)
+		if err != nil {
+			return changed, err
+		}
+
+		if !moved {
+			err = addLocalRule(family, localRulePriority)
+			if err != nil {
+				return changed, err
+			}
+			changed = true
+		}
+
+		if original {
+			err = delLocalRule(family, 0)
+			if err != nil {
+				return changed, err
+			}
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// restoreLocalRules puts the local table rule back to preference 0
+// for both ipv4 and ipv6.
+func restoreLocalRules() error {
+	for _, family := range ruleFamilies {
+		original, moved, err := localRules(family)
+		if err != nil {
+			return err
+		}
+
+		if !original {
+			err = addLocalRule(family, 0)
+			if err != nil {
+				return err
+			}
+		}
+
+		if moved {
+			err = delLocalRule(family, localRulePriority)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// localRules tells whether the local table rule exists with preference 0
+// and with localRulePriority for the given family.
+func localRules(family int) (bool, bool, error) {
+	rules, err := nlh.RuleListFiltered(family, &netlink.Rule{Table: unix.RT_TABLE_LOCAL}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return false, false, fmt.Errorf("failed listing rules: %w", err)
+	}
+
+	original, moved := false, false
+	for _, r := range rules {
+		// The kernel does not report the preference when it's 0.
+		if r.Priority <= 0 {
+			original = true
+		}
+		if r.Priority == localRulePriority {
+			moved = true
+		}
+	}
+	return original, moved, nil
+}
+
+func addLocalRule(family, priority int) error {
+	rule := netlink.NewRule()
+	rule.Family = family
+	rule.Table = unix.RT_TABLE_LOCAL
+	rule.Priority = priority
+	err := nlh.RuleAdd(rule)
+	if err != nil {
+		return fmt.Errorf("could not add local table rule with preference %d: %w", priority, err)
+	}
+	return nil
+}
+
+func delLocalRule(family, priority int) error {
+	rule := netlink.NewRule()
+	rule.Family = family
+	rule.Table = unix.RT_TABLE_LOCAL
+	rule.Priority = priority
+	err := nlh.RuleDel(rule)
+	if err != nil {
+		return fmt.Errorf("could not delete local table rule with preference %d: %w", priority, err)
+	}
+	return nil
+}
@@ -1,3 +1,9 @@
 #!/bin/sh
-ginkgo build .
+set -e
+# The specs that create netns and links are behind the privileged build tag
+# and run as root, the others run as the current user.
+go test ./...
+go test -c -tags privileged -o vrf-cni.test .
+go test -c -tags privileged -o vrf-lib.test ./pkg/vrf
 sudo ./vrf-cni.test
+sudo ./vrf-lib.test
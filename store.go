@@ -0,0 +1,167 @@
+// Copyright 2020 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+const defaultDataDir = "/var/lib/cni/vrf"
+
+// attachment records an interface added to a VRF, so that GC can
+// find the sandboxes to clean up once the runtime forgot about them.
+type attachment struct {
+	ContainerID string `json:"containerID"`
+	IfName      string `json:"ifname"`
+	Netns       string `json:"netns"`
+	VRFName     string `json:"vrfName"`
+}
+
+// store persists the attachments of a given network on disk.
+type store struct {
+	dir string
+}
+
+func newStore(dataDir, network string) *store {
+	if dataDir == "" {
+		dataDir = defaultDataDir
+	}
+	return &store{dir: filepath.Join(dataDir, network)}
+}
+
+func (s *store) path(containerID, ifName string) string {
+	return filepath.Join(s.dir, containerID+"-"+ifName)
+}
+
+// save records the given attachment, overwriting any previous record.
+func (s *store) save(a attachment) error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return fmt.Errorf("could not create data dir %s: %v", s.dir, err)
+	}
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	path := s.path(a.ContainerID, a.IfName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("could not write attachment %s: %v", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("could not write attachment %s: %v", path, err)
+	}
+	return nil
+}
+
+// remove deletes the record of the given attachment. Removing an attachment
+// that was never recorded is not an error.
+func (s *store) remove(containerID, ifName string) error {
+	err := os.Remove(s.path(containerID, ifName))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove attachment %s/%s: %v", containerID, ifName, err)
+	}
+	return nil
+}
+
+// list returns all the recorded attachments.
+func (s *store) list() ([]attachment, error) {
+	entries, err := os.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read data dir %s: %v", s.dir, err)
+	}
+
+	res := make([]attachment, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) == ".tmp" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("could not read attachment %s: %v", e.Name(), err)
+		}
+		a := attachment{}
+		if err := json.Unmarshal(data, &a); err != nil {
+			return nil, fmt.Errorf("could not parse attachment %s: %v", e.Name(), err)
+		}
+		res = append(res, a)
+	}
+	return res, nil
+}
+
+// sysctlStore persists the original values of the sysctls changed in a
+// sandbox, so they can be restored when its last VRF is deleted. The values
+// are per sandbox and not per network, so they are kept in a directory whose
+// name is not a valid network name.
+type sysctlStore struct {
+	dir string
+}
+
+func newSysctlStore(dataDir string) *sysctlStore {
+	if dataDir == "" {
+		dataDir = defaultDataDir
+	}
+	return &sysctlStore{dir: filepath.Join(dataDir, ".sysctls")}
+}
+
+// save records the original sysctl values of the given sandbox.
+func (s *sysctlStore) save(containerID string, values map[string]string) error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return newError(types.ErrIOFailure, causeOf(err), "could not create data dir %s: %v", s.dir, err)
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, containerID)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return newError(types.ErrIOFailure, causeOf(err), "could not write sysctls %s: %v", path, err)
+	}
+	return nil
+}
+
+// load returns the original sysctl values of the given sandbox, or nil
+// if none were recorded.
+func (s *sysctlStore) load(containerID string) (map[string]string, error) {
+	path := filepath.Join(s.dir, containerID)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, newError(types.ErrIOFailure, causeOf(err), "could not read sysctls %s: %v", path, err)
+	}
+	values := map[string]string{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, newError(types.ErrIOFailure, causeOf(err), "could not parse sysctls %s: %v", path, err)
+	}
+	return values, nil
+}
+
+// remove deletes the original sysctl values of the given sandbox.
+func (s *sysctlStore) remove(containerID string) error {
+	err := os.Remove(filepath.Join(s.dir, containerID))
+	if err != nil && !os.IsNotExist(err) {
+		return newError(types.ErrIOFailure, causeOf(err), "could not remove sysctls of %s: %v", containerID, err)
+	}
+	return nil
+}
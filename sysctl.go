@@ -0,0 +1,68 @@
+// Copyright 2020 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+)
+
+// l3mdevSysctls are the sysctls that can be set through the configuration.
+var l3mdevSysctls = map[string]struct{}{
+	"net.ipv4.tcp_l3mdev_accept": {},
+	"net.ipv4.udp_l3mdev_accept": {},
+	"net.ipv4.raw_l3mdev_accept": {},
+}
+
+func validateSysctls(values map[string]string) error {
+	for name := range values {
+		if _, ok := l3mdevSysctls[name]; !ok {
+			return fmt.Errorf("sysctl %s is not supported", name)
+		}
+	}
+	return nil
+}
+
+// applySysctls sets the given sysctls in the current netns, and returns
+// their previous values.
+func applySysctls(values map[string]string) (map[string]string, error) {
+	original := make(map[string]string, len(values))
+	for name, value := range values {
+		old, err := sysctl.Sysctl(name)
+		if err != nil {
+			return original, newError(types.ErrIOFailure, causeOf(err), "could not read sysctl %s: %v", name, err)
+		}
+		_, err = sysctl.Sysctl(name, value)
+		if err != nil {
+			return original, newError(types.ErrIOFailure, causeOf(err), "could not set sysctl %s to %s: %v", name, value, err)
+		}
+		original[name] = old
+	}
+	return original, nil
+}
+
+// restoreSysctls sets the given sysctls back in the current netns.
+func restoreSysctls(values map[string]string) error {
+	errs := make([]error, 0)
+	for name, value := range values {
+		_, err := sysctl.Sysctl(name, value)
+		if err != nil {
+			errs = append(errs, newError(types.ErrIOFailure, causeOf(err), "could not restore sysctl %s to %s: %v", name, value, err))
+		}
+	}
+	return joinErrors(errs)
+}
@@ -15,163 +15,268 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
-	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 
+	types100 "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	libvrf "github.com/fedepaol/vrfcni/pkg/vrf"
 )
 
 // findVRF finds a VRF link with the provided name.
 func findVRF(name string) (*netlink.Vrf, error) {
-	link, err := netlink.LinkByName(name)
+	vrf, err := libvrf.FindVRF(nlh, name)
 	if err != nil {
+		debugf("findVRF: %s: %v", name, err)
 		return nil, err
 	}
-	vrf, ok := link.(*netlink.Vrf)
-	if !ok {
-		return nil, fmt.Errorf("Netlink %s is not a VRF", name)
-	}
+	debugf("findVRF: found vrf %s with index %d and table %d", name, vrf.Index, vrf.Table)
 	return vrf, nil
 }
 
-// createVRF creates a new VRF and sets it up.
-func createVRF(name string, tableID uint32) (*netlink.Vrf, error) {
-	links, err := netlink.LinkList()
-	if err != nil {
-		return nil, fmt.Errorf("createVRF: Failed to find links %v", err)
+// delUnreachableDefaultRoutes removes the ipv4 and ipv6 unreachable default
+// routes from the routing table of the VRF.
+func delUnreachableDefaultRoutes(vrf *netlink.Vrf) error {
+	for _, dst := range defaultDestinations {
+		route := &netlink.Route{
+			Dst:      dst,
+			Type:     unix.RTN_UNREACHABLE,
+			Priority: unreachableDefaultMetric,
+			Table:    int(vrf.Table),
+		}
+		err := nlh.RouteDel(route)
+		if err != nil && err != unix.ESRCH {
+			return fmt.Errorf("could not delete unreachable default route %s from VRF %s: %w", dst, vrf.Name, err)
+		}
 	}
+	return nil
+}
 
-	if tableID != 0 {
-		if vrf, ok := findVRFForTable(tableID, links); ok {
-			return nil, fmt.Errorf("Can't create VRF %s with tableid %d, already used by %s", name, tableID, vrf)
+// addVRFRoutes installs the given static routes in the routing table of the VRF.
+func addVRFRoutes(vrf *netlink.Vrf, routes []VRFRoute) error {
+	for _, r := range routes {
+		route, err := vrfRouteToNetlink(vrf, r)
+		if err != nil {
+			return err
 		}
-	} else {
-		tableID, err = findFreeRoutingTableID(links)
+		err = nlh.RouteReplace(route)
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("could not add route %s to VRF %s: %w", route, vrf.Name, err)
 		}
 	}
+	return nil
+}
 
-	vrf := &netlink.Vrf{
-		LinkAttrs: netlink.LinkAttrs{
-			Name: name,
-		},
-		Table: tableID,
+// delVRFRoutes removes the given static routes from the routing table of the VRF.
+// Routes that are already gone are ignored.
+func delVRFRoutes(vrf *netlink.Vrf, routes []VRFRoute) error {
+	for _, r := range routes {
+		route, err := vrfRouteToNetlink(vrf, r)
+		if libvrf.IsLinkNotFound(err) {
+			// The device is gone, and so is the route.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = nlh.RouteDel(route)
+		if err != nil && err != unix.ESRCH {
+			return fmt.Errorf("could not delete route %s from VRF %s: %w", route, vrf.Name, err)
+		}
 	}
+	return nil
+}
 
-	err = netlink.LinkAdd(vrf)
-	if err != nil {
-		return nil, fmt.Errorf("could not add VRF %s: %v", name, err)
-	}
-	err = netlink.LinkSetUp(vrf)
-	if err != nil {
-		return nil, fmt.Errorf("could not set link up for VRF %s: %v", name, err)
+// checkVRFRoutes verifies that the given static routes are in the routing table of the VRF.
+func checkVRFRoutes(vrf *netlink.Vrf, routes []VRFRoute) error {
+	for _, r := range routes {
+		route, err := vrfRouteToNetlink(vrf, r)
+		if err != nil {
+			return err
+		}
+		filter := &netlink.Route{
+			Dst:   route.Dst,
+			Table: route.Table,
+		}
+		found, err := nlh.RouteListFiltered(netlink.FAMILY_ALL, filter, netlink.RT_FILTER_DST|netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return fmt.Errorf("failed getting routes for VRF %s: %w", vrf.Name, err)
+		}
+		if !hasRoute(found, route) {
+			return driftError(fmt.Sprintf("table %d", vrf.Table), "route %s not found in VRF %s", route, vrf.Name)
+		}
 	}
-
-	return vrf, nil
+	return nil
 }
 
-// assignedInterfaces returns the list of interfaces associated to the given vrf.
-func assignedInterfaces(vrf *netlink.Vrf) ([]netlink.Link, error) {
-	links, err := netlink.LinkList()
-	if err != nil {
-		return nil, fmt.Errorf("getAssignedInterfaces: Failed to find links %v", err)
-	}
-	res := make([]netlink.Link, 0)
-	for _, l := range links {
-		if l.Attrs().MasterIndex == vrf.Index {
-			res = append(res, l)
+// hasRoute tells if the route is among the given ones. As when deleting a
+// route, a metric of 0 matches any metric, since the kernel stores the ipv6
+// routes added without one with metric 1024.
+func hasRoute(routes []netlink.Route, route *netlink.Route) bool {
+	for _, r := range routes {
+		if !r.Gw.Equal(route.Gw) {
+			continue
+		}
+		if route.Priority != 0 && r.Priority != route.Priority {
+			continue
 		}
+		if route.LinkIndex != 0 && r.LinkIndex != route.LinkIndex {
+			continue
+		}
+		return true
 	}
-	return res, nil
+	return false
 }
 
-// addInterface adds the given interface to the VRF
-func addInterface(vrf *netlink.Vrf, intf string) error {
-	i, err := netlink.LinkByName(intf)
-	if err != nil {
-		return fmt.Errorf("could not get link by name %s", intf)
+func vrfRouteToNetlink(vrf *netlink.Vrf, r VRFRoute) (*netlink.Route, error) {
+	dst := net.IPNet(r.Dst)
+	route := &netlink.Route{
+		Dst:      &dst,
+		Gw:       r.GW,
+		Priority: r.Metric,
+		Table:    int(vrf.Table),
 	}
-
-	if i.Attrs().MasterIndex != 0 {
-		master, err := netlink.LinkByIndex(i.Attrs().MasterIndex)
+	if r.Dev != "" {
+		link, err := nlh.LinkByName(r.Dev)
 		if err != nil {
-			return fmt.Errorf("interface %s has already a master set, could not retrieve the name: %v", intf, err)
+			return nil, err
 		}
-		return fmt.Errorf("interface %s has already a master set: %s", intf, master.Attrs().Name)
+		route.LinkIndex = link.Attrs().Index
 	}
+	return route, nil
+}
 
-	// IPV6 addresses are not maintained unless
-	// sysctl -w net.ipv6.conf.all.keep_addr_on_down=1 is called
-	// so we save it, and restore it back.
-	beforeAddresses, err := netlink.AddrList(i, netlink.FAMILY_V6)
-	if err != nil {
-		return fmt.Errorf("failed getting ipv6 addresses for %s", intf)
-	}
-	err = netlink.LinkSetMaster(i, vrf)
-	if err != nil {
-		return fmt.Errorf("could not set vrf %s as master of %s: %v", vrf.Name, intf, err)
-	}
+// unreachableDefaultMetric is the metric of the unreachable default routes,
+// 0xFF000000 as in the kernel VRF documentation. It is high enough for any
+// other default route of the VRF to win, but not the highest possible one.
+const unreachableDefaultMetric = 4278198272
 
-	afterAddresses, err := netlink.AddrList(i, netlink.FAMILY_V6)
-	if err != nil {
-		return fmt.Errorf("failed getting ipv6 new addresses for %s", intf)
+var defaultDestinations = []*net.IPNet{
+	{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+	{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+}
+
+// addUnreachableDefaultRoutes installs the ipv4 and ipv6 unreachable default
+// routes in the routing table of the VRF.
+func addUnreachableDefaultRoutes(vrf *netlink.Vrf) error {
+	for _, dst := range defaultDestinations {
+		route := &netlink.Route{
+			Dst:      dst,
+			Type:     unix.RTN_UNREACHABLE,
+			Priority: unreachableDefaultMetric,
+			Table:    int(vrf.Table),
+		}
+		err := nlh.RouteReplace(route)
+		if err != nil {
+			return fmt.Errorf("could not add unreachable default route %s to VRF %s: %w", dst, vrf.Name, err)
+		}
 	}
+	return nil
+}
 
-	// Since keeping the ipv6 address depends on net.ipv6.conf.all.keep_addr_on_down ,
-	// we check if the new interface does not have them and in case we restore them.
+// checkUnreachableDefaultRoutes verifies that the ipv4 and ipv6 unreachable
+// default routes are in the routing table of the VRF.
+func checkUnreachableDefaultRoutes(vrf *netlink.Vrf) error {
 CONTINUE:
-	for _, toFind := range beforeAddresses {
-		for _, current := range afterAddresses {
-			if toFind.Equal(current) {
-				continue CONTINUE
-			}
+	for _, dst := range defaultDestinations {
+		filter := &netlink.Route{
+			Type:  unix.RTN_UNREACHABLE,
+			Table: int(vrf.Table),
 		}
-		// Not found, re-adding it
-		err = netlink.AddrAdd(i, &toFind)
+		family := netlink.FAMILY_V6
+		if dst.IP.To4() != nil {
+			family = netlink.FAMILY_V4
+		}
+		routes, err := nlh.RouteListFiltered(family, filter, netlink.RT_FILTER_TYPE|netlink.RT_FILTER_TABLE)
 		if err != nil {
-			return fmt.Errorf("could not restore address %s to %s @ %s: %v", toFind, intf, vrf.Name, err)
+			return fmt.Errorf("failed getting routes for VRF %s: %w", vrf.Name, err)
 		}
+		for _, r := range routes {
+			if r.Priority != unreachableDefaultMetric {
+				continue
+			}
+			// The kernel reports default routes without destination.
+			if r.Dst == nil {
+				continue CONTINUE
+			}
+			if ones, _ := r.Dst.Mask.Size(); ones == 0 {
+				continue CONTINUE
+			}
+		}
+		return driftError(fmt.Sprintf("table %d", vrf.Table), "unreachable default route %s not found in VRF %s", dst, vrf.Name)
 	}
-
 	return nil
 }
 
-func findVRFForTable(tableID uint32, links []netlink.Link) (string, bool) {
-	for _, l := range links {
-		if vrf, ok := l.(*netlink.Vrf); ok {
-			if vrf.Table == tableID {
-				return vrf.Name, true
+// checkAddresses verifies that all the given ips are assigned to the interface.
+func checkAddresses(intf netlink.Link, ips []*types100.IPConfig) error {
+	addresses, err := nlh.AddrList(intf, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed getting addresses for %s: %w", intf.Attrs().Name, err)
+	}
+
+CONTINUE:
+	for _, ip := range ips {
+		for _, a := range addresses {
+			if a.IPNet.String() == ip.Address.String() {
+				continue CONTINUE
 			}
 		}
+		return driftError("link "+intf.Attrs().Name, "address %s not found on interface %s", ip.Address.String(), intf.Attrs().Name)
 	}
-	return "", false
+	return nil
 }
 
-func findFreeRoutingTableID(links []netlink.Link) (uint32, error) {
-	takenTables := make(map[uint32]struct{}, len(links))
-	for _, l := range links {
-		if vrf, ok := l.(*netlink.Vrf); ok {
-			takenTables[vrf.Table] = struct{}{}
-		}
+// vrfKernelSupport returns an error if the vrf module is neither loaded,
+// built into the kernel nor available to be loaded on demand.
+func vrfKernelSupport() error {
+	if _, err := os.Stat("/sys/module/vrf"); err == nil {
+		return nil
 	}
 
-	for res := uint32(1); res < math.MaxUint32; res++ {
-		if _, ok := takenTables[res]; !ok {
-			return res, nil
+	uname := unix.Utsname{}
+	if err := unix.Uname(&uname); err != nil {
+		return fmt.Errorf("could not get kernel release: %w", err)
+	}
+	release := unix.ByteSliceToString(uname.Release[:])
+	for _, f := range []string{"modules.builtin", "modules.dep"} {
+		found, err := hasVRFModule(filepath.Join("/lib/modules", release, f))
+		if err != nil {
+			return err
+		}
+		if found {
+			return nil
 		}
 	}
-	return 0, fmt.Errorf("findFreeRoutingTableID: Failed to find an available routing id")
+	return fmt.Errorf("vrf module not found for kernel %s", release)
 }
 
-func resetMaster(interfaceName string) error {
-	intf, err := netlink.LinkByName(interfaceName)
-	if err != nil {
-		return fmt.Errorf("resetMaster: could not get link by name %s", interfaceName)
+func hasVRFModule(path string) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
 	}
-	err = netlink.LinkSetNoMaster(intf)
 	if err != nil {
-		return fmt.Errorf("resetMaster: could reset master to %s", interfaceName)
+		return false, fmt.Errorf("could not read %s: %w", path, err)
 	}
-	return nil
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		module := strings.SplitN(scanner.Text(), ":", 2)[0]
+		name := filepath.Base(module)
+		if name == "vrf.ko" || strings.HasPrefix(name, "vrf.ko.") {
+			return true, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("could not read %s: %w", path, err)
+	}
+	return false, nil
 }
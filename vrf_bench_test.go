@@ -0,0 +1,126 @@
+// Copyright 2020 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build privileged
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/vishvananda/netlink"
+
+	libvrf "github.com/fedepaol/vrfcni/pkg/vrf"
+)
+
+// benchVRFs is how many VRFs the benchmark netns holds, the links being
+// spread evenly among them.
+const benchVRFs = 100
+
+// setupBenchNS creates a netns with the given number of dummy links
+// enslaved to benchVRFs VRFs.
+func setupBenchNS(b *testing.B, links int) ns.NetNS {
+	b.Helper()
+	netns, err := testutils.NewNS()
+	if err != nil {
+		b.Fatalf("could not create netns: %v", err)
+	}
+	b.Cleanup(func() {
+		netns.Close()
+		testutils.UnmountNS(netns)
+	})
+
+	err = netns.Do(func(ns.NetNS) error {
+		vrfs := make([]*netlink.Vrf, 0, benchVRFs)
+		for i := 0; i < benchVRFs; i++ {
+			vrf := &netlink.Vrf{
+				LinkAttrs: netlink.LinkAttrs{Name: fmt.Sprintf("vrf%d", i)},
+				Table:     uint32(1000 + i),
+			}
+			if err := netlink.LinkAdd(vrf); err != nil {
+				return err
+			}
+			vrfs = append(vrfs, vrf)
+		}
+		for i := 0; i < links; i++ {
+			dummy := &netlink.Dummy{
+				LinkAttrs: netlink.LinkAttrs{
+					Name:        fmt.Sprintf("dummy%d", i),
+					MasterIndex: vrfs[i%benchVRFs].Index,
+				},
+			}
+			if err := netlink.LinkAdd(dummy); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatalf("could not set up netns: %v", err)
+	}
+	return netns
+}
+
+func benchmarkAllocateTable(b *testing.B, links int) {
+	netns := setupBenchNS(b, links)
+
+	b.ResetTimer()
+	err := netns.Do(func(ns.NetNS) error {
+		for i := 0; i < b.N; i++ {
+			// A manager dumps the links once, as an ADD does.
+			m := libvrf.NewManager(nlh, nil)
+			if _, err := m.AllocateTable("bench"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+func benchmarkAssignedInterfaces(b *testing.B, links int) {
+	netns := setupBenchNS(b, links)
+
+	b.ResetTimer()
+	err := netns.Do(func(ns.NetNS) error {
+		vrf, err := findVRF("vrf0")
+		if err != nil {
+			return err
+		}
+		for i := 0; i < b.N; i++ {
+			snapshot, err := libvrf.TakeSnapshot(nlh)
+			if err != nil {
+				return err
+			}
+			if len(snapshot.AssignedInterfaces(vrf)) != links/benchVRFs {
+				return fmt.Errorf("unexpected interfaces in %s", vrf.Name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkAllocateTable1k(b *testing.B)  { benchmarkAllocateTable(b, 1000) }
+func BenchmarkAllocateTable10k(b *testing.B) { benchmarkAllocateTable(b, 10000) }
+
+func BenchmarkAssignedInterfaces1k(b *testing.B)  { benchmarkAssignedInterfaces(b, 1000) }
+func BenchmarkAssignedInterfaces10k(b *testing.B) { benchmarkAssignedInterfaces(b, 10000) }
@@ -0,0 +1,394 @@
+// Copyright 2020 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	libvrf "github.com/fedepaol/vrfcni/pkg/vrf"
+	"github.com/fedepaol/vrfcni/pkg/vrf/vrftest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// These tests run the plugin against an in-memory netns, so they do not
+// need root.
+var _ = Describe("vrf plugin on a fake netlink", func() {
+	var fake *vrftest.Fake
+	var dataDir string
+	const (
+		IF0Name  = "eth0"
+		IF1Name  = "eth1"
+		VRF0Name = "vrf0"
+		VRF1Name = "vrf1"
+		netns    = "/var/run/netns/fake"
+	)
+
+	gw := net.ParseIP("10.0.0.1")
+	_, routeDst, _ := net.ParseCIDR("10.10.0.0/16")
+
+	fakeConf := func(intf, vrf, extra string) []byte {
+		return []byte(fmt.Sprintf(`{
+	"name": "test",
+	"type": "vrf",
+	"cniVersion": "1.0.0",
+	"vrfName": "%s",
+	"dataDir": "%s",
+	%s
+	"prevResult": {
+		"cniVersion": "1.0.0",
+		"interfaces": [
+			{"name": "%s", "sandbox": "%s"}
+		],
+		"ips": [
+			{"address": "10.0.0.2/24", "gateway": "10.0.0.1", "interface": 0}
+		]
+	}
+}`, vrf, dataDir, extra, intf, netns))
+	}
+
+	argsFor := func(intf string, conf []byte) *skel.CmdArgs {
+		return &skel.CmdArgs{
+			ContainerID: "dummy-" + intf,
+			Netns:       netns,
+			IfName:      intf,
+			StdinData:   conf,
+		}
+	}
+
+	add := func(args *skel.CmdArgs) error {
+		_, _, err := testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		return err
+	}
+
+	del := func(args *skel.CmdArgs) error {
+		return testutils.CmdDelWithArgs(args, func() error {
+			return cmdDel(args)
+		})
+	}
+
+	addLink := func(name, ipv4, ipv6 string) {
+		Expect(fake.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name, Flags: net.FlagUp}})).To(Succeed())
+		link, err := fake.LinkByName(name)
+		Expect(err).NotTo(HaveOccurred())
+		for _, a := range []string{ipv4, ipv6} {
+			addr, err := netlink.ParseAddr(a)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fake.AddrAdd(link, addr)).To(Succeed())
+		}
+	}
+
+	// masterOf returns the name of the master of the link, if any.
+	masterOf := func(name string) string {
+		link, err := fake.LinkByName(name)
+		Expect(err).NotTo(HaveOccurred())
+		if link.Attrs().MasterIndex == 0 {
+			return ""
+		}
+		master, err := fake.LinkByIndex(link.Attrs().MasterIndex)
+		Expect(err).NotTo(HaveOccurred())
+		return master.Attrs().Name
+	}
+
+	// routeTable returns the table of the static route through eth0.
+	routeTable := func() int {
+		routes, err := fake.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Dst: routeDst}, netlink.RT_FILTER_TABLE|netlink.RT_FILTER_DST)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(routes).To(HaveLen(1))
+		return routes[0].Table
+	}
+
+	expectCode := func(err error, code uint) *types.Error {
+		var cniErr *types.Error
+		Expect(errors.As(err, &cniErr)).To(BeTrue(), fmt.Sprintf("%v is not a CNI error", err))
+		Expect(cniErr.Code).To(Equal(code), cniErr.Msg)
+		return cniErr
+	}
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = os.MkdirTemp("", "vrf-fake")
+		Expect(err).NotTo(HaveOccurred())
+
+		fake = vrftest.NewFake()
+		nlh = fake
+		enterNetNS = func(_ string, toRun func(ns.NetNS) error) error {
+			return toRun(nil)
+		}
+
+		addLink(IF0Name, "10.0.0.2/24", "2001:db8::2/64")
+		addLink(IF1Name, "10.0.1.2/24", "2001:db8:1::2/64")
+		Expect(fake.RouteReplace(&netlink.Route{Dst: routeDst, Gw: gw})).To(Succeed())
+	})
+
+	AfterEach(func() {
+		nlh = libvrf.Kernel()
+		enterNetNS = ns.WithNetNSPath
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	It("moves the interface and its routes to the VRF and back", func() {
+		args := argsFor(IF0Name, fakeConf(IF0Name, VRF0Name, ""))
+		r, _, err := testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		vrf, err := libvrf.FindVRF(fake, VRF0Name)
+		Expect(err).NotTo(HaveOccurred())
+		result, err := types100.GetResult(r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Interfaces).To(HaveLen(2))
+		Expect(result.Interfaces[1].Name).To(Equal(VRF0Name))
+		Expect(result.Interfaces[1].Mac).To(Equal(vrf.HardwareAddr.String()))
+		Expect(result.Interfaces[1].Mac).NotTo(BeEmpty())
+		Expect(masterOf(IF0Name)).To(Equal(VRF0Name))
+		Expect(routeTable()).To(Equal(int(vrf.Table)))
+
+		link, err := fake.LinkByName(IF0Name)
+		Expect(err).NotTo(HaveOccurred())
+		addrs, err := fake.AddrList(link, netlink.FAMILY_V6)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(addrs).To(HaveLen(1))
+
+		Expect(del(args)).To(Succeed())
+		_, err = libvrf.FindVRF(fake, VRF0Name)
+		Expect(libvrf.IsLinkNotFound(err)).To(BeTrue())
+		Expect(masterOf(IF0Name)).To(BeEmpty())
+		addrs, err = fake.AddrList(link, netlink.FAMILY_V6)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(addrs).To(HaveLen(1))
+
+		attachments, err := newStore(dataDir, "test").list()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(attachments).To(BeEmpty())
+	})
+
+	It("frees the table of a VRF with strict isolation", func() {
+		args := argsFor(IF0Name, fakeConf(IF0Name, VRF0Name, `"table": 100, "strictIsolation": true,`))
+		Expect(add(args)).To(Succeed())
+		routes, err := fake.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: 100, Type: unix.RTN_UNREACHABLE},
+			netlink.RT_FILTER_TABLE|netlink.RT_FILTER_TYPE)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(routes).To(HaveLen(2))
+
+		Expect(del(args)).To(Succeed())
+		routes, err = fake.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: 100}, netlink.RT_FILTER_TABLE)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(routes).To(BeEmpty())
+	})
+
+	It("checks the ipv6 static routes without a metric", func() {
+		args := argsFor(IF0Name, fakeConf(IF0Name, VRF0Name, `"routes": [{"dst": "2001:db8:30::/64", "gw": "2001:db8::1"}],`))
+		Expect(add(args)).To(Succeed())
+		Expect(testutils.CmdCheckWithArgs(args, func() error {
+			return cmdCheck(args)
+		})).To(Succeed())
+
+		Expect(del(args)).To(Succeed())
+		_, dst, _ := net.ParseCIDR("2001:db8:30::/64")
+		routes, err := fake.RouteListFiltered(netlink.FAMILY_V6, &netlink.Route{Dst: dst}, netlink.RT_FILTER_TABLE|netlink.RT_FILTER_DST)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(routes).To(BeEmpty())
+	})
+
+	It("checks the addresses with no interface index", func() {
+		conf := strings.Replace(string(fakeConf(IF0Name, VRF0Name, "")),
+			`{"address": "10.0.0.2/24", "gateway": "10.0.0.1", "interface": 0}`,
+			`{"address": "10.0.0.2/24", "gateway": "10.0.0.1", "interface": 0}, {"address": "10.0.0.5/24"}`, 1)
+		args := argsFor(IF0Name, []byte(conf))
+		Expect(add(args)).To(Succeed())
+
+		err := testutils.CmdCheckWithArgs(args, func() error {
+			return cmdCheck(args)
+		})
+		Expect(err).To(MatchError(ContainSubstring("address 10.0.0.5/24 not found on interface " + IF0Name)))
+	})
+
+	It("keeps the VRF until its last interface is removed", func() {
+		args0 := argsFor(IF0Name, fakeConf(IF0Name, VRF0Name, ""))
+		args1 := argsFor(IF1Name, fakeConf(IF1Name, VRF0Name, ""))
+		Expect(add(args0)).To(Succeed())
+		Expect(add(args1)).To(Succeed())
+
+		Expect(del(args0)).To(Succeed())
+		_, err := libvrf.FindVRF(fake, VRF0Name)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(masterOf(IF1Name)).To(Equal(VRF0Name))
+
+		Expect(del(args1)).To(Succeed())
+		_, err = libvrf.FindVRF(fake, VRF0Name)
+		Expect(libvrf.IsLinkNotFound(err)).To(BeTrue())
+	})
+
+	It("tells misconfigurations and drift from netlink failures", func() {
+		args := argsFor("missing", fakeConf("missing", VRF0Name, ""))
+		err := add(args)
+		Expect(expectCode(err, errInterfaceNotFound).Details).To(Equal("link missing"))
+
+		tableRange := `"tableRange": {"min": 2000, "max": 2000},`
+		Expect(add(argsFor(IF0Name, fakeConf(IF0Name, VRF0Name, tableRange)))).To(Succeed())
+		err = add(argsFor(IF1Name, fakeConf(IF1Name, VRF1Name, tableRange)))
+		Expect(expectCode(err, errNoTableAvailable).Details).To(Equal("tables 2000-2000"))
+
+		link, err := fake.LinkByName(IF0Name)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fake.LinkSetNoMaster(link)).To(Succeed())
+		args = argsFor(IF0Name, fakeConf(IF0Name, VRF0Name, tableRange))
+		err = testutils.CmdCheckWithArgs(args, func() error {
+			return cmdCheck(args)
+		})
+		Expect(expectCode(err, errDrift).Details).To(Equal("link " + IF0Name))
+	})
+
+	It("rolls back a failed ADD", func() {
+		fake.Errors["LinkSetMaster"] = unix.EPERM
+
+		args := argsFor(IF0Name, fakeConf(IF0Name, VRF0Name, `"strictIsolation": true,`))
+		err := add(args)
+		Expect(expectCode(err, errNetlink).Details).To(Equal("EPERM: operation not permitted"))
+
+		_, err = libvrf.FindVRF(fake, VRF0Name)
+		Expect(libvrf.IsLinkNotFound(err)).To(BeTrue())
+		Expect(masterOf(IF0Name)).To(BeEmpty())
+		Expect(routeTable()).To(Equal(unix.RT_TABLE_MAIN))
+
+		attachments, err := newStore(dataDir, "test").list()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(attachments).To(BeEmpty())
+	})
+
+	It("reports a duplicate address as a configuration error", func() {
+		fake.KeepAddrOnDown = true
+		link, err := fake.LinkByName(IF0Name)
+		Expect(err).NotTo(HaveOccurred())
+		addr, err := netlink.ParseAddr("2001:db8::3/64")
+		Expect(err).NotTo(HaveOccurred())
+		addr.Flags = unix.IFA_F_DADFAILED
+		Expect(fake.AddrAdd(link, addr)).To(Succeed())
+		// The code of the failure is kept when the rollback fails too.
+		fake.Errors["LinkDel"] = unix.EPERM
+
+		args := argsFor(IF0Name, fakeConf(IF0Name, VRF0Name, `"waitDAD": true,`))
+		err = add(args)
+		expectCode(err, types.ErrInvalidNetworkConfig)
+		Expect(err.Error()).To(ContainSubstring("duplicate address 2001:db8::3/64"))
+		Expect(err.Error()).To(ContainSubstring("rollback failed"))
+	})
+
+	It("restores the routes when moving them to the VRF fails", func() {
+		fake.Errors["RouteDel"] = unix.EPERM
+
+		args := argsFor(IF0Name, fakeConf(IF0Name, VRF0Name, ""))
+		Expect(add(args)).NotTo(Succeed())
+
+		Expect(masterOf(IF0Name)).To(BeEmpty())
+		Expect(routeTable()).To(Equal(unix.RT_TABLE_MAIN))
+		link, err := fake.LinkByName(IF0Name)
+		Expect(err).NotTo(HaveOccurred())
+		addrs, err := fake.AddrList(link, netlink.FAMILY_V6)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(addrs).To(HaveLen(1))
+	})
+
+	It("does not take an interface from another VRF", func() {
+		Expect(add(argsFor(IF0Name, fakeConf(IF0Name, VRF0Name, "")))).To(Succeed())
+
+		err := add(argsFor(IF0Name, fakeConf(IF0Name, VRF1Name, "")))
+		expectCode(err, errInterfaceHasMaster)
+		Expect(masterOf(IF0Name)).To(Equal(VRF0Name))
+		_, err = libvrf.FindVRF(fake, VRF1Name)
+		Expect(libvrf.IsLinkNotFound(err)).To(BeTrue())
+	})
+
+	It("fails on a table used by another VRF", func() {
+		Expect(add(argsFor(IF0Name, fakeConf(IF0Name, VRF0Name, `"table": 100,`)))).To(Succeed())
+
+		err := add(argsFor(IF1Name, fakeConf(IF1Name, VRF1Name, `"table": 100,`)))
+		expectCode(err, errTableConflict)
+		err = add(argsFor(IF1Name, fakeConf(IF1Name, VRF0Name, `"table": 101,`)))
+		expectCode(err, errTableConflict)
+		Expect(masterOf(IF1Name)).To(BeEmpty())
+	})
+
+	It("deletes the VRF of the last interface when detaching it fails", func() {
+		args := argsFor(IF0Name, fakeConf(IF0Name, VRF0Name, ""))
+		Expect(add(args)).To(Succeed())
+		fake.Errors["LinkSetNoMaster"] = unix.EPERM
+
+		Expect(del(args)).NotTo(Succeed())
+		_, err := libvrf.FindVRF(fake, VRF0Name)
+		Expect(libvrf.IsLinkNotFound(err)).To(BeTrue())
+		Expect(masterOf(IF0Name)).To(BeEmpty())
+	})
+
+	It("deletes an interface whose VRF or link is already gone", func() {
+		args := argsFor(IF0Name, fakeConf(IF0Name, VRF0Name, ""))
+		Expect(add(args)).To(Succeed())
+		vrf, err := libvrf.FindVRF(fake, VRF0Name)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fake.LinkDel(vrf)).To(Succeed())
+
+		Expect(del(args)).To(Succeed())
+		Expect(del(args)).To(Succeed())
+
+		args = argsFor(IF1Name, fakeConf(IF1Name, VRF1Name, ""))
+		Expect(add(args)).To(Succeed())
+		link, err := fake.LinkByName(IF1Name)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fake.LinkDel(link)).To(Succeed())
+
+		Expect(del(args)).To(Succeed())
+		_, err = libvrf.FindVRF(fake, VRF1Name)
+		Expect(libvrf.IsLinkNotFound(err)).To(BeTrue())
+		attachments, err := newStore(dataDir, "test").list()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(attachments).To(BeEmpty())
+	})
+
+	It("locks the netns without creating files", func() {
+		path := filepath.Join(dataDir, "netns")
+		Expect(os.WriteFile(path, nil, 0600)).To(Succeed())
+
+		err := withNetNSLock(path, func() error {
+			f, err := os.Open(path)
+			Expect(err).NotTo(HaveOccurred())
+			defer f.Close()
+			return unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		})
+		Expect(err).To(Equal(unix.EWOULDBLOCK))
+
+		entries, err := os.ReadDir(dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+	})
+})
@@ -1,16 +1,26 @@
+//go:build privileged
+
 package main
 
 import (
 	"encoding/json"
 	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
-	"github.com/containernetworking/cni/pkg/types/current"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	libvrf "github.com/fedepaol/vrfcni/pkg/vrf"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo/extensions/table"
@@ -109,7 +119,7 @@ var _ = Describe("vrf plugin", func() {
 	})
 
 	It("passes prevResult through unchanged", func() {
-		conf := confFor("test", IF0Name, VRF0Name, "10.0.0.2/24")
+		conf := confFor("test", IF0Name, VRF0Name, "10.0.0.2/24", "")
 
 		args := &skel.CmdArgs{
 			ContainerID: "dummy",
@@ -126,20 +136,56 @@ var _ = Describe("vrf plugin", func() {
 			})
 			Expect(err).NotTo(HaveOccurred())
 
-			result, err := current.GetResult(r)
+			result, err := types100.GetResult(r)
 			Expect(err).NotTo(HaveOccurred())
 
-			Expect(len(result.Interfaces)).To(Equal(1))
+			Expect(len(result.Interfaces)).To(Equal(2))
 			Expect(result.Interfaces[0].Name).To(Equal(IF0Name))
 			Expect(len(result.IPs)).To(Equal(1))
 			Expect(result.IPs[0].Address.String()).To(Equal("10.0.0.2/24"))
+			Expect(*result.IPs[0].Interface).To(Equal(0))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("reports the VRF in the result", func() {
+		conf := confWithTableFor("test", IF0Name, VRF0Name, "10.0.0.2/24", 1001, "")
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IF0Name,
+			StdinData:   conf,
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, out, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(result.Interfaces)).To(Equal(2))
+			Expect(result.Interfaces[1].Name).To(Equal(VRF0Name))
+			Expect(result.Interfaces[1].Sandbox).To(Equal(targetNS.Path()))
+			Expect(result.Interfaces[1].Mac).NotTo(BeEmpty())
+
+			raw := struct {
+				VRF VRFInfo `json:"vrf"`
+			}{}
+			Expect(json.Unmarshal(out, &raw)).To(Succeed())
+			Expect(raw.VRF).To(Equal(VRFInfo{Name: VRF0Name, Table: 1001, Interface: 1}))
 			return nil
 		})
 		Expect(err).NotTo(HaveOccurred())
 	})
 
 	It("configures a VRF and adds the interface to it", func() {
-		conf := confFor("test", IF0Name, VRF0Name, "10.0.0.2/24")
+		conf := confFor("test", IF0Name, VRF0Name, "10.0.0.2/24", "")
 
 		args := &skel.CmdArgs{
 			ContainerID: "dummy",
@@ -165,27 +211,83 @@ var _ = Describe("vrf plugin", func() {
 		Expect(err).NotTo(HaveOccurred())
 	})
 
-	It("fails if the interface already has a master set", func() {
-		conf := confFor("test", IF0Name, VRF0Name, "10.0.0.2/24")
+	It("moves the routes through the interface to the VRF table", func() {
+		conf := confWithTableFor("test", IF0Name, VRF0Name, "10.0.0.2/24", 1001, "")
+		_, dst, err := net.ParseCIDR("10.10.10.0/24")
+		Expect(err).NotTo(HaveOccurred())
 
-		By("Setting the interface's master", func() {
+		By("Adding a route through the interface", func() {
 			err := targetNS.Do(func(ns.NetNS) error {
 				defer GinkgoRecover()
 				l, err := netlink.LinkByName(IF0Name)
 				Expect(err).NotTo(HaveOccurred())
-				br := &netlink.Bridge{
-					LinkAttrs: netlink.LinkAttrs{
-						Name: "testrbridge",
-					},
-				}
-				err = netlink.LinkAdd(br)
+				addr, err := netlink.ParseAddr("10.0.0.2/24")
 				Expect(err).NotTo(HaveOccurred())
-				err = netlink.LinkSetMaster(l, br)
+				Expect(netlink.AddrAdd(l, addr)).To(Succeed())
+				Expect(netlink.LinkSetUp(l)).To(Succeed())
+				err = netlink.RouteAdd(&netlink.Route{
+					LinkIndex: l.Attrs().Index,
+					Dst:       dst,
+					Gw:        net.ParseIP("10.0.0.1"),
+					Priority:  100,
+				})
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IF0Name,
+				StdinData:   conf,
+			}
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		By("Checking the route is in the VRF table only", func() {
+			err := targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				l, err := netlink.LinkByName(IF0Name)
+				Expect(err).NotTo(HaveOccurred())
+
+				routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{
+					Dst:   dst,
+					Table: 1001,
+				}, netlink.RT_FILTER_DST|netlink.RT_FILTER_TABLE)
 				Expect(err).NotTo(HaveOccurred())
+				Expect(routes).To(HaveLen(1))
+				Expect(routes[0].LinkIndex).To(Equal(l.Attrs().Index))
+				Expect(routes[0].Gw.String()).To(Equal("10.0.0.1"))
+				Expect(routes[0].Priority).To(Equal(100))
+
+				routes, err = netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{
+					Dst: dst,
+				}, netlink.RT_FILTER_DST)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(routes).To(BeEmpty())
 				return nil
 			})
 			Expect(err).NotTo(HaveOccurred())
 		})
+	})
+
+	It("installs, checks and removes the static routes of the VRF", func() {
+		extra := fmt.Sprintf(`"table": 1001,
+			"routes": [
+				{"dst": "10.20.0.0/16", "gw": "10.0.0.1", "metric": 50, "dev": "%s"},
+				{"dst": "10.30.0.0/16", "gw": "10.0.0.1"},
+				{"dst": "2001:db8:30::/64", "gw": "2001:db8::1"}
+			],`, IF0Name)
+		conf := confVersionFor("1.0.0", "test", IF0Name, VRF0Name, extra, "10.0.0.2/24")
 
 		args := &skel.CmdArgs{
 			ContainerID: "dummy",
@@ -194,162 +296,728 @@ var _ = Describe("vrf plugin", func() {
 			StdinData:   conf,
 		}
 
-		err := originalNS.Do(func(ns.NetNS) error {
+		err := targetNS.Do(func(ns.NetNS) error {
 			defer GinkgoRecover()
-			_, _, err := testutils.CmdAddWithArgs(args, func() error {
-				return cmdAdd(args)
-			})
-			Expect(err).To(HaveOccurred())
-			Expect(err.Error()).To(ContainSubstring("has already a master set"))
+			l, err := netlink.LinkByName(IF0Name)
+			Expect(err).NotTo(HaveOccurred())
+			addr, err := netlink.ParseAddr("10.0.0.2/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(l, addr)).To(Succeed())
+			addr6, err := netlink.ParseAddr("2001:db8::2/64")
+			Expect(err).NotTo(HaveOccurred())
+			addr6.Flags = unix.IFA_F_NODAD
+			Expect(netlink.AddrAdd(l, addr6)).To(Succeed())
+			Expect(netlink.LinkSetUp(l)).To(Succeed())
 			return nil
 		})
 		Expect(err).NotTo(HaveOccurred())
-	})
-
-	DescribeTable("handles two interfaces",
-		func(vrf0, vrf1, ip0, ip1 string) {
-			conf0 := confFor("test", IF0Name, vrf0, ip0)
-			conf1 := confFor("test1", IF1Name, vrf1, ip1)
 
-			addr0, err := netlink.ParseAddr(ip0)
-			Expect(err).NotTo(HaveOccurred())
-			addr1, err := netlink.ParseAddr(ip1)
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
 			Expect(err).NotTo(HaveOccurred())
 
-			By("Setting the first interface's ip", func() {
-				err := targetNS.Do(func(ns.NetNS) error {
-					l, err := netlink.LinkByName(IF0Name)
-					Expect(err).NotTo(HaveOccurred())
+			// The ipv6 route without a metric is stored with metric 1024.
+			err = testutils.CmdCheckWithArgs(args, func() error {
+				return cmdCheck(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
 
-					err = netlink.AddrAdd(l, addr0)
-					Expect(err).NotTo(HaveOccurred())
+		_, dst, err := net.ParseCIDR("10.20.0.0/16")
+		Expect(err).NotTo(HaveOccurred())
 
-					return nil
-				})
+		By("Checking the routes are in the VRF table", func() {
+			err := targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{
+					Table: 1001,
+				}, netlink.RT_FILTER_TABLE)
 				Expect(err).NotTo(HaveOccurred())
-			})
 
-			By("Adding the first interface to first vrf", func() {
-				err := originalNS.Do(func(ns.NetNS) error {
-					defer GinkgoRecover()
-					args := &skel.CmdArgs{
-						ContainerID: "dummy",
-						Netns:       targetNS.Path(),
-						IfName:      IF0Name,
-						StdinData:   conf0,
+				dsts := []string{}
+				for _, r := range routes {
+					if r.Dst != nil {
+						dsts = append(dsts, r.Dst.String())
 					}
-					_, _, err := testutils.CmdAddWithArgs(args, func() error {
-						return cmdAdd(args)
-					})
-					Expect(err).NotTo(HaveOccurred())
-					return nil
-				})
+				}
+				Expect(dsts).To(ContainElement("10.20.0.0/16"))
+				Expect(dsts).To(ContainElement("10.30.0.0/16"))
+
+				routes, err = netlink.RouteListFiltered(netlink.FAMILY_V6, &netlink.Route{
+					Table: 1001,
+				}, netlink.RT_FILTER_TABLE)
 				Expect(err).NotTo(HaveOccurred())
+				dsts = []string{}
+				for _, r := range routes {
+					if r.Dst != nil {
+						dsts = append(dsts, r.Dst.String())
+					}
+				}
+				Expect(dsts).To(ContainElement("2001:db8:30::/64"))
+				return nil
 			})
+			Expect(err).NotTo(HaveOccurred())
+		})
 
-			By("Setting the second interface's ip", func() {
-				err := targetNS.Do(func(ns.NetNS) error {
-					l, err := netlink.LinkByName(IF1Name)
-					Expect(err).NotTo(HaveOccurred())
+		By("Checking that CHECK fails when a route is removed", func() {
+			err := targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				Expect(netlink.RouteDel(&netlink.Route{Dst: dst, Table: 1001})).To(Succeed())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
 
-					err = netlink.AddrAdd(l, addr1)
-					Expect(err).NotTo(HaveOccurred())
-					return nil
+			err = originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				err := testutils.CmdCheckWithArgs(args, func() error {
+					return cmdCheck(args)
 				})
-				Expect(err).NotTo(HaveOccurred())
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("not found in VRF vrf0"))
+				return nil
 			})
+			Expect(err).NotTo(HaveOccurred())
+		})
 
-			By("Adding the second interface to second vrf", func() {
-				err := originalNS.Do(func(ns.NetNS) error {
-					defer GinkgoRecover()
-					args := &skel.CmdArgs{
-						ContainerID: "dummy",
-						Netns:       targetNS.Path(),
-						IfName:      IF1Name,
-						StdinData:   conf1,
-					}
-					_, _, err := testutils.CmdAddWithArgs(args, func() error {
-						return cmdAdd(args)
-					})
-					Expect(err).NotTo(HaveOccurred())
-					return nil
+		By("Removing the VRF and its routes on DEL", func() {
+			err := originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				err := testutils.CmdDelWithArgs(args, func() error {
+					return cmdDel(args)
 				})
 				Expect(err).NotTo(HaveOccurred())
+				return nil
 			})
+			Expect(err).NotTo(HaveOccurred())
 
-			By("Checking that the first interface is added to first vrf", func() {
-				err := targetNS.Do(func(ns.NetNS) error {
-					defer GinkgoRecover()
-					checkInterfaceOnVRF(vrf0, IF0Name)
+			err = targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				_, err := netlink.LinkByName(VRF0Name)
+				Expect(err).To(HaveOccurred())
+				routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{
+					Table: 1001,
+				}, netlink.RT_FILTER_TABLE)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(routes).To(BeEmpty())
 
-					link, err := netlink.LinkByName(IF0Name)
-					Expect(err).NotTo(HaveOccurred())
-					addresses, err := netlink.AddrList(link, netlink.FAMILY_ALL)
-					Expect(len(addresses)).To(Equal(1))
-					Expect(addresses[0].IP.Equal(addr0.IP)).To(BeTrue())
-					Expect(addresses[0].Mask).To(Equal(addr0.Mask))
-					return nil
-				})
+				// The ipv6 route does not follow the interface back to the main table.
+				_, dst6, err := net.ParseCIDR("2001:db8:30::/64")
+				Expect(err).NotTo(HaveOccurred())
+				routes, err = netlink.RouteListFiltered(netlink.FAMILY_V6, &netlink.Route{
+					Dst: dst6,
+				}, netlink.RT_FILTER_DST)
 				Expect(err).NotTo(HaveOccurred())
+				Expect(routes).To(BeEmpty())
+				return nil
 			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
 
-			By("Checking that the second interface is added to second vrf", func() {
-				err := targetNS.Do(func(ns.NetNS) error {
-					defer GinkgoRecover()
-					checkInterfaceOnVRF(vrf0, IF0Name)
+	It("installs the unreachable default routes with strict isolation", func() {
+		conf := confVersionFor("1.0.0", "test", IF0Name, VRF0Name, `"table": 1001, "strictIsolation": true,`)
 
-					link, err := netlink.LinkByName(IF1Name)
-					Expect(err).NotTo(HaveOccurred())
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IF0Name,
+			StdinData:   conf,
+		}
 
-					addresses, err := netlink.AddrList(link, netlink.FAMILY_ALL)
-					Expect(len(addresses)).To(Equal(1))
-					Expect(addresses[0].IP.Equal(addr1.IP)).To(BeTrue())
-					Expect(addresses[0].Mask).To(Equal(addr1.Mask))
-					return nil
-				})
-				Expect(err).NotTo(HaveOccurred())
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
 			})
+			Expect(err).NotTo(HaveOccurred())
 
-			By("Checking that when the vrfs are different, the routing table is different", func() {
-				if vrf0 == vrf1 {
-					return
-				}
-				err := targetNS.Do(func(ns.NetNS) error {
-					defer GinkgoRecover()
-					l0, err := netlink.LinkByName(vrf0)
-					Expect(err).NotTo(HaveOccurred())
-					Expect(l0).To(BeAssignableToTypeOf(&netlink.Vrf{}))
-					l1, err := netlink.LinkByName(vrf1)
-					Expect(err).NotTo(HaveOccurred())
-					Expect(l1).To(BeAssignableToTypeOf(&netlink.Vrf{}))
+			err = testutils.CmdCheckWithArgs(args, func() error {
+				return cmdCheck(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
 
-					vrf0Link := l0.(*netlink.Vrf)
-					vrf1Link := l1.(*netlink.Vrf)
-					Expect(vrf0Link.Table).NotTo(Equal(vrf1Link.Table))
-					return nil
-				})
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+				routes, err := netlink.RouteListFiltered(family, &netlink.Route{
+					Type:  unix.RTN_UNREACHABLE,
+					Table: 1001,
+				}, netlink.RT_FILTER_TYPE|netlink.RT_FILTER_TABLE)
 				Expect(err).NotTo(HaveOccurred())
-			})
+				Expect(routes).To(HaveLen(1))
+				Expect(routes[0].Priority).To(Equal(4278198272))
 
-		},
-		Entry("added to the same vrf", VRF0Name, VRF0Name, "10.0.0.2/24", "10.0.0.3/24"),
-		Entry("added to different vrfs", VRF0Name, VRF1Name, "10.0.0.2/24", "10.0.0.3/24"),
-		Entry("added to different vrfs with same ip", VRF0Name, VRF1Name, "10.0.0.2/24", "10.0.0.2/24"),
-		Entry("added to the same vrf IPV6", VRF0Name, VRF0Name, "2A00:0C98:2060:A000:0001:0000:1d1e:ca75/64", "2A00:0C98:2060:A000:0001:0000:1d1e:ca76/64"),
-		Entry("added to different vrfs IPV6", VRF0Name, VRF1Name, "2A00:0C98:2060:A000:0001:0000:1d1e:ca75/64", "2A00:0C98:2060:A000:0001:0000:1d1e:ca76/64"),
-		Entry("added to different vrfs with same ip IPV6", VRF0Name, VRF1Name, "2A00:0C98:2060:A000:0001:0000:1d1e:ca75/64", "2A00:0C98:2060:A000:0001:0000:1d1e:ca75/64"),
-	)
+				Expect(netlink.RouteDel(&routes[0])).To(Succeed())
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
 
-	DescribeTable("handle tableid conflicts",
-		func(vrf0, vrf1 string, tableid0, tableid1 int, expectedError string) {
-			conf0 := confWithTableFor("test", IF0Name, vrf0, "10.0.0.2/24", tableid0)
-			conf1 := confWithTableFor("test1", IF1Name, vrf1, "10.0.0.2/24", tableid1)
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			err := testutils.CmdCheckWithArgs(args, func() error {
+				return cmdCheck(args)
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("unreachable default route"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
 
-			By("Adding the first interface to first vrf", func() {
-				err := originalNS.Do(func(ns.NetNS) error {
-					defer GinkgoRecover()
-					args := &skel.CmdArgs{
-						ContainerID: "dummy",
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			vrf, err := findVRF(VRF0Name)
+			Expect(err).NotTo(HaveOccurred())
+			return addUnreachableDefaultRoutes(vrf)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// Nothing is left behind in the table of the deleted VRF.
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: 1001}, netlink.RT_FILTER_TABLE)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes).To(BeEmpty())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("ensures the l3mdev rules and moves the local rule after them", func() {
+		conf0 := confVersionFor("1.0.0", "test", IF0Name, VRF0Name, `"moveLocalRule": true,`)
+		conf1 := confVersionFor("1.0.0", "test1", IF1Name, VRF1Name, `"moveLocalRule": true,`)
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			for _, a := range []struct {
+				ifName string
+				conf   []byte
+			}{{IF0Name, conf0}, {IF1Name, conf1}} {
+				args := &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNS.Path(),
+					IfName:      a.ifName,
+					StdinData:   a.conf,
+				}
+				_, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+				found, err := libvrf.HasL3mdevRule(nlh, family)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(found).To(BeTrue())
+
+				rules, err := netlink.RuleListFiltered(family, &netlink.Rule{Table: unix.RT_TABLE_LOCAL}, netlink.RT_FILTER_TABLE)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(rules).To(HaveLen(1))
+				Expect(rules[0].Priority).To(Equal(32765))
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("sets the sysctls with the first VRF and restores them with the last one", func() {
+		sysctls := `"sysctls": {
+			"net.ipv4.tcp_l3mdev_accept": "1",
+			"net.ipv4.udp_l3mdev_accept": "1"
+		},`
+		args0 := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IF0Name,
+			StdinData:   confFor("test", IF0Name, VRF0Name, "10.0.0.2/24", sysctls),
+		}
+		args1 := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IF1Name,
+			StdinData:   confFor("test1", IF1Name, VRF1Name, "10.0.0.2/24", sysctls),
+		}
+
+		checkSysctls := func(expected string) {
+			err := targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				for _, name := range []string{"net.ipv4.tcp_l3mdev_accept", "net.ipv4.udp_l3mdev_accept"} {
+					value, err := sysctl.Sysctl(name)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(value).To(Equal(expected))
+				}
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			for _, args := range []*skel.CmdArgs{args0, args1} {
+				_, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		checkSysctls("1")
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			err := testutils.CmdDelWithArgs(args0, func() error {
+				return cmdDel(args0)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		checkSysctls("1")
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			err := testutils.CmdDelWithArgs(args1, func() error {
+				return cmdDel(args1)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		checkSysctls("0")
+	})
+
+	It("fails if the VRF has the name of the interface", func() {
+		conf := confFor("test", IF0Name, IF0Name, "10.0.0.2/24", "")
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IF0Name,
+				StdinData:   conf,
+			}
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("vrf name dummy0 is the same as the interface name"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	DescribeTable("returns typed errors",
+		func(conf string, cmd func(*skel.CmdArgs) error, code uint) {
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IF0Name,
+				StdinData:   []byte(conf),
+			}
+			err := originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				err := cmd(args)
+				Expect(err).To(HaveOccurred())
+				cniErr, ok := err.(*types.Error)
+				Expect(ok).To(BeTrue())
+				Expect(cniErr.Code).To(Equal(code))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		},
+		Entry("on a config that can't be decoded", `{"name": "test", "vrfName": 1}`,
+			cmdAdd, types.ErrDecodingFailure),
+		Entry("on an invalid config", `{"name": "test", "cniVersion": "1.0.0", "vrfName": "vrf0", "table": 254}`,
+			cmdAdd, types.ErrInvalidNetworkConfig),
+		Entry("on ADD without prevResult", `{"name": "test", "cniVersion": "1.0.0", "vrfName": "vrf0"}`,
+			cmdAdd, types.ErrInvalidNetworkConfig),
+		Entry("on CHECK of a missing vrf", `{"name": "test", "cniVersion": "1.0.0", "vrfName": "vrf0", "prevResult": {"cniVersion": "1.0.0"}}`,
+			cmdCheck, errVRFNotFound),
+	)
+
+	It("fails if the interface already has a master set", func() {
+		conf := confFor("test", IF0Name, VRF0Name, "10.0.0.2/24", "")
+
+		By("Setting the interface's master", func() {
+			err := targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				l, err := netlink.LinkByName(IF0Name)
+				Expect(err).NotTo(HaveOccurred())
+				br := &netlink.Bridge{
+					LinkAttrs: netlink.LinkAttrs{
+						Name: "testrbridge",
+					},
+				}
+				err = netlink.LinkAdd(br)
+				Expect(err).NotTo(HaveOccurred())
+				err = netlink.LinkSetMaster(l, br)
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IF0Name,
+			StdinData:   conf,
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("has already a master set"))
+			cniErr, ok := err.(*types.Error)
+			Expect(ok).To(BeTrue())
+			Expect(cniErr.Code).To(Equal(errInterfaceHasMaster))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		By("Checking that the VRF was rolled back", func() {
+			err := targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				_, err := netlink.LinkByName(VRF0Name)
+				Expect(err).To(BeAssignableToTypeOf(netlink.LinkNotFoundError{}))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	It("restores the netns when ADD fails after adding the interface", func() {
+		extra := `"strictIsolation": true,
+			"sysctls": {
+				"net.ipv4.tcp_l3mdev_accept": "1"
+			},
+			"routes": [
+				{"dst": "10.20.0.0/16", "gw": "10.0.0.1", "dev": "doesnotexist"}
+			],`
+		conf := confVersionFor("1.0.0", "test", IF0Name, VRF0Name, extra)
+
+		ipv6, err := netlink.ParseAddr("2001:db8::2/64")
+		Expect(err).NotTo(HaveOccurred())
+		_, dst, err := net.ParseCIDR("10.10.10.0/24")
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			l, err := netlink.LinkByName(IF0Name)
+			Expect(err).NotTo(HaveOccurred())
+			addr, err := netlink.ParseAddr("10.0.0.2/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(l, addr)).To(Succeed())
+			Expect(netlink.AddrAdd(l, ipv6)).To(Succeed())
+			Expect(netlink.LinkSetUp(l)).To(Succeed())
+			err = netlink.RouteAdd(&netlink.Route{
+				LinkIndex: l.Attrs().Index,
+				Dst:       dst,
+				Gw:        net.ParseIP("10.0.0.1"),
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IF0Name,
+				StdinData:   conf,
+			}
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).To(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, err := netlink.LinkByName(VRF0Name)
+			Expect(err).To(BeAssignableToTypeOf(netlink.LinkNotFoundError{}))
+			checkLinkHasNoMaster(IF0Name)
+
+			l, err := netlink.LinkByName(IF0Name)
+			Expect(err).NotTo(HaveOccurred())
+			addresses, err := netlink.AddrList(l, netlink.FAMILY_V6)
+			Expect(err).NotTo(HaveOccurred())
+			found := false
+			for _, a := range addresses {
+				if a.Equal(*ipv6) {
+					found = true
+				}
+			}
+			Expect(found).To(BeTrue())
+
+			routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{
+				Dst: dst,
+			}, netlink.RT_FILTER_DST)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes).To(HaveLen(1))
+
+			routes, err = netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{
+				Type: unix.RTN_UNREACHABLE,
+			}, netlink.RT_FILTER_TYPE|netlink.RT_FILTER_TABLE)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes).To(BeEmpty())
+
+			value, err := sysctl.Sysctl("net.ipv4.tcp_l3mdev_accept")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal("0"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		entries, err := os.ReadDir(filepath.Join(testDataDir, "test"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(BeEmpty())
+	})
+
+	It("serializes concurrent ADDs in the same netns", func() {
+		const parallel = 16
+
+		ifName := func(i int) string { return fmt.Sprintf("stress%d", i) }
+		vrfName := func(i int) string {
+			// Half of the interfaces share the same vrf.
+			if i%2 == 0 {
+				return VRF0Name
+			}
+			return fmt.Sprintf("vrfstress%d", i)
+		}
+
+		err := targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			for i := 0; i < parallel; i++ {
+				err := netlink.LinkAdd(&netlink.Dummy{
+					LinkAttrs: netlink.LinkAttrs{
+						Name: ifName(i),
+					},
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		var wg sync.WaitGroup
+		errs := make([]error, parallel)
+		for i := 0; i < parallel; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				conf := confVersionFor("1.0.0", fmt.Sprintf("test%d", i), ifName(i), vrfName(i), "")
+				errs[i] = cmdAdd(&skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNS.Path(),
+					IfName:      ifName(i),
+					StdinData:   conf,
+				})
+			}(i)
+		}
+		wg.Wait()
+
+		for _, err := range errs {
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			for i := 0; i < parallel; i++ {
+				checkInterfaceOnVRF(vrfName(i), ifName(i))
+			}
+
+			tables := map[uint32]string{}
+			links, err := netlink.LinkList()
+			Expect(err).NotTo(HaveOccurred())
+			for _, l := range links {
+				vrf, ok := l.(*netlink.Vrf)
+				if !ok {
+					continue
+				}
+				Expect(tables).NotTo(HaveKey(vrf.Table))
+				tables[vrf.Table] = vrf.Name
+			}
+			Expect(tables).To(HaveLen(parallel/2 + 1))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	DescribeTable("handles two interfaces",
+		func(vrf0, vrf1, ip0, ip1 string) {
+			conf0 := confFor("test", IF0Name, vrf0, ip0, "")
+			conf1 := confFor("test1", IF1Name, vrf1, ip1, "")
+
+			addr0, err := netlink.ParseAddr(ip0)
+			Expect(err).NotTo(HaveOccurred())
+			addr1, err := netlink.ParseAddr(ip1)
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Setting the first interface's ip", func() {
+				err := targetNS.Do(func(ns.NetNS) error {
+					l, err := netlink.LinkByName(IF0Name)
+					Expect(err).NotTo(HaveOccurred())
+
+					err = netlink.AddrAdd(l, addr0)
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			By("Adding the first interface to first vrf", func() {
+				err := originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+					args := &skel.CmdArgs{
+						ContainerID: "dummy",
+						Netns:       targetNS.Path(),
+						IfName:      IF0Name,
+						StdinData:   conf0,
+					}
+					_, _, err := testutils.CmdAddWithArgs(args, func() error {
+						return cmdAdd(args)
+					})
+					Expect(err).NotTo(HaveOccurred())
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			By("Setting the second interface's ip", func() {
+				err := targetNS.Do(func(ns.NetNS) error {
+					l, err := netlink.LinkByName(IF1Name)
+					Expect(err).NotTo(HaveOccurred())
+
+					err = netlink.AddrAdd(l, addr1)
+					Expect(err).NotTo(HaveOccurred())
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			By("Adding the second interface to second vrf", func() {
+				err := originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+					args := &skel.CmdArgs{
+						ContainerID: "dummy",
+						Netns:       targetNS.Path(),
+						IfName:      IF1Name,
+						StdinData:   conf1,
+					}
+					_, _, err := testutils.CmdAddWithArgs(args, func() error {
+						return cmdAdd(args)
+					})
+					Expect(err).NotTo(HaveOccurred())
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			By("Checking that the first interface is added to first vrf", func() {
+				err := targetNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+					checkInterfaceOnVRF(vrf0, IF0Name)
+
+					link, err := netlink.LinkByName(IF0Name)
+					Expect(err).NotTo(HaveOccurred())
+					addresses, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+					Expect(len(addresses)).To(Equal(1))
+					Expect(addresses[0].IP.Equal(addr0.IP)).To(BeTrue())
+					Expect(addresses[0].Mask).To(Equal(addr0.Mask))
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			By("Checking that the second interface is added to second vrf", func() {
+				err := targetNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+					checkInterfaceOnVRF(vrf0, IF0Name)
+
+					link, err := netlink.LinkByName(IF1Name)
+					Expect(err).NotTo(HaveOccurred())
+
+					addresses, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+					Expect(len(addresses)).To(Equal(1))
+					Expect(addresses[0].IP.Equal(addr1.IP)).To(BeTrue())
+					Expect(addresses[0].Mask).To(Equal(addr1.Mask))
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			By("Checking that when the vrfs are different, the routing table is different", func() {
+				if vrf0 == vrf1 {
+					return
+				}
+				err := targetNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+					l0, err := netlink.LinkByName(vrf0)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(l0).To(BeAssignableToTypeOf(&netlink.Vrf{}))
+					l1, err := netlink.LinkByName(vrf1)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(l1).To(BeAssignableToTypeOf(&netlink.Vrf{}))
+
+					vrf0Link := l0.(*netlink.Vrf)
+					vrf1Link := l1.(*netlink.Vrf)
+					Expect(vrf0Link.Table).NotTo(Equal(vrf1Link.Table))
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+		},
+		Entry("added to the same vrf", VRF0Name, VRF0Name, "10.0.0.2/24", "10.0.0.3/24"),
+		Entry("added to different vrfs", VRF0Name, VRF1Name, "10.0.0.2/24", "10.0.0.3/24"),
+		Entry("added to different vrfs with same ip", VRF0Name, VRF1Name, "10.0.0.2/24", "10.0.0.2/24"),
+		Entry("added to the same vrf IPV6", VRF0Name, VRF0Name, "2A00:0C98:2060:A000:0001:0000:1d1e:ca75/64", "2A00:0C98:2060:A000:0001:0000:1d1e:ca76/64"),
+		Entry("added to different vrfs IPV6", VRF0Name, VRF1Name, "2A00:0C98:2060:A000:0001:0000:1d1e:ca75/64", "2A00:0C98:2060:A000:0001:0000:1d1e:ca76/64"),
+		Entry("added to different vrfs with same ip IPV6", VRF0Name, VRF1Name, "2A00:0C98:2060:A000:0001:0000:1d1e:ca75/64", "2A00:0C98:2060:A000:0001:0000:1d1e:ca75/64"),
+	)
+
+	DescribeTable("handle tableid conflicts",
+		func(vrf0, vrf1 string, tableid0, tableid1 int, expectedError string) {
+			conf0 := confWithTableFor("test", IF0Name, vrf0, "10.0.0.2/24", tableid0, "")
+			conf1 := confWithTableFor("test1", IF1Name, vrf1, "10.0.0.2/24", tableid1, "")
+
+			By("Adding the first interface to first vrf", func() {
+				err := originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+					args := &skel.CmdArgs{
+						ContainerID: "dummy",
 						Netns:       targetNS.Path(),
 						IfName:      IF0Name,
 						StdinData:   conf0,
@@ -363,101 +1031,736 @@ var _ = Describe("vrf plugin", func() {
 				Expect(err).NotTo(HaveOccurred())
 			})
 
-			By("Checking that the first vrf has the right routing table", func() {
+			By("Checking that the first vrf has the right routing table", func() {
+				err := targetNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					l, err := netlink.LinkByName(vrf0)
+					Expect(err).NotTo(HaveOccurred())
+					vrf := l.(*netlink.Vrf)
+					Expect(vrf.Table).To(Equal(uint32(tableid0)))
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			By("Adding the second interface to second vrf", func() {
+				err := originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+					args := &skel.CmdArgs{
+						ContainerID: "dummy",
+						Netns:       targetNS.Path(),
+						IfName:      IF1Name,
+						StdinData:   conf1,
+					}
+					_, _, err := testutils.CmdAddWithArgs(args, func() error {
+						return cmdAdd(args)
+					})
+
+					if expectedError != "" {
+						Expect(err).To(HaveOccurred())
+						Expect(err.Error()).To(ContainSubstring(expectedError))
+					} else {
+						Expect(err).NotTo(HaveOccurred())
+					}
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+		},
+		Entry("same vrf with same tableid", VRF0Name, VRF0Name, 1001, 1001, ""),
+		Entry("same vrf with different tableids", VRF0Name, VRF0Name, 1001, 1002, "already exist with different routing table"),
+		Entry("different vrf with same tableid", VRF0Name, VRF1Name, 1001, 1001, "already used by"),
+	)
+
+	It("allocates the tables from the configured range", func() {
+		tableRange := `"tableRange": {"min": 2000, "max": 2002}, "denyTables": [2001],`
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			for i, vrf := range []string{VRF0Name, VRF1Name} {
+				intf := []string{IF0Name, IF1Name}[i]
+				args := &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNS.Path(),
+					IfName:      intf,
+					StdinData:   confFor(fmt.Sprintf("test%d", i), intf, vrf, "10.0.0.2/24", tableRange),
+				}
+				_, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IF0Name,
+				StdinData:   confFor("test2", IF0Name, "vrf2", "10.0.0.2/24", tableRange),
+			}
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("no routing table available in range 2000-2002"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			for vrf, table := range map[string]uint32{VRF0Name: 2000, VRF1Name: 2002} {
+				l, err := netlink.LinkByName(vrf)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(l.(*netlink.Vrf).Table).To(Equal(table))
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("derives the tables from the VRF names in hash mode", func() {
+		hash := `"tableAllocation": "hash", "tableRange": {"min": 10000, "max": 19999},`
+
+		tables, err := libvrf.NewTablePolicy(&libvrf.TableRange{Min: 10000, Max: 19999}, nil, libvrf.AllocationHash)
+		Expect(err).NotTo(HaveOccurred())
+		expected := map[string]uint32{}
+		for _, vrf := range []string{VRF0Name, VRF1Name} {
+			expected[vrf], err = tables.Allocate(vrf, nil)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(expected[VRF0Name]).NotTo(Equal(expected[VRF1Name]))
+
+		// The VRFs are created in reverse order, and still get the
+		// tables derived from their names.
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			for i, vrf := range []string{VRF1Name, VRF0Name} {
+				intf := []string{IF1Name, IF0Name}[i]
+				args := &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNS.Path(),
+					IfName:      intf,
+					StdinData:   confFor(fmt.Sprintf("test%d", i), intf, vrf, "10.0.0.2/24", hash),
+				}
+				_, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			for vrf, table := range expected {
+				l, err := netlink.LinkByName(vrf)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(l.(*netlink.Vrf).Table).To(Equal(table))
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("does not allocate tables used by routes or rules", func() {
+		conf := confFor("test", IF0Name, VRF0Name, "10.0.0.2/24", `"tableRange": {"min": 2000, "max": 2002},`)
+
+		err := targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			l, err := netlink.LinkByName(IF1Name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(l)).To(Succeed())
+			_, dst, err := net.ParseCIDR("2001:db8:1::/64")
+			Expect(err).NotTo(HaveOccurred())
+			err = netlink.RouteAdd(&netlink.Route{
+				LinkIndex: l.Attrs().Index,
+				Dst:       dst,
+				Table:     2000,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			rule := netlink.NewRule()
+			rule.Family = netlink.FAMILY_V4
+			rule.Priority = 100
+			rule.Mark = 1
+			rule.Table = 2001
+			Expect(netlink.RuleAdd(rule)).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IF0Name,
+				StdinData:   conf,
+			}
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			l, err := netlink.LinkByName(VRF0Name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(l.(*netlink.Vrf).Table).To(Equal(uint32(2002)))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("removes the VRF only when the last interface is removed", func() {
+		conf0 := confFor("test", IF0Name, VRF0Name, "10.0.0.2/24", "")
+		conf1 := confFor("test1", IF1Name, VRF0Name, "10.0.0.2/24", "")
+
+		By("Adding the two interfaces to the VRF", func() {
+			err := originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				args := &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNS.Path(),
+					IfName:      IF0Name,
+					StdinData:   conf0,
+				}
+				_, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				args = &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNS.Path(),
+					IfName:      IF1Name,
+					StdinData:   conf1,
+				}
+				_, _, err = testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		By("Checking that the two interfaces are added to the VRF", func() {
+			targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				checkInterfaceOnVRF(VRF0Name, IF0Name)
+				checkInterfaceOnVRF(VRF0Name, IF1Name)
+				return nil
+			})
+		})
+
+		By("Removing the first interface from VRF, removing the interface", func() {
+			err := originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				args := &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNS.Path(),
+					IfName:      IF0Name,
+					StdinData:   conf0,
+				}
+				err := testutils.CmdDelWithArgs(args, func() error {
+					return cmdDel(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = targetNS.Do(func(ns.NetNS) error {
+				link, err := netlink.LinkByName(IF0Name)
+				Expect(err).NotTo(HaveOccurred())
+				err = netlink.LinkDel(link)
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		By("Checking that the second interface is still on the VRF and that VRF still exists", func() {
+			targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				checkInterfaceOnVRF(VRF0Name, IF1Name)
+				return nil
+			})
+		})
+
+		By("Removing the second interface from VRF, deleting the second interface", func() {
+			err := originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				args := &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNS.Path(),
+					IfName:      IF1Name,
+					StdinData:   conf1,
+				}
+				err := testutils.CmdDelWithArgs(args, func() error {
+					return cmdDel(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = targetNS.Do(func(ns.NetNS) error {
+				link, err := netlink.LinkByName(IF1Name)
+				Expect(err).NotTo(HaveOccurred())
+				err = netlink.LinkDel(link)
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		By("Checking that the VRF is removed", func() {
+			targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				_, err := netlink.LinkByName(VRF0Name)
+				Expect(err).NotTo(BeNil())
+				return nil
+			})
+		})
+	})
+
+	It("configures and deconfigures mtu with CNI 0.4.0 ADD/DEL", func() {
+		conf := []byte(fmt.Sprintf(`{
+	"name": "test",
+	"type": "vrf",
+	"cniVersion": "0.4.0",
+	"vrfName": "%s",
+	"prevResult": {
+		"interfaces": [
+			{"name": "%s", "sandbox":"netns"}
+		],
+		"ips": [
+			{
+				"version": "4",
+				"address": "10.0.0.2/24",
+				"gateway": "10.0.0.1",
+				"interface": 0
+			}
+		]
+	}
+}`, VRF0Name, IF0Name))
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IF0Name,
+			StdinData:   conf,
+		}
+		err := targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			addr, err := netlink.ParseAddr("10.0.0.2/24")
+			Expect(err).NotTo(HaveOccurred())
+			l, err := netlink.LinkByName(IF0Name)
+			Expect(err).NotTo(HaveOccurred())
+			err = netlink.AddrAdd(l, addr)
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		var prevRes types.Result
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			prevRes, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err := types100.GetResult(prevRes)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(len(result.Interfaces)).To(Equal(2))
+			Expect(result.Interfaces[0].Name).To(Equal(IF0Name))
+			Expect(result.Interfaces[1].Name).To(Equal(VRF0Name))
+			Expect(len(result.IPs)).To(Equal(1))
+			Expect(result.IPs[0].Address.String()).To(Equal("10.0.0.2/24"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			checkInterfaceOnVRF(VRF0Name, IF0Name)
+			return nil
+		})
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			cniVersion := "0.4.0"
+			n := &VRFNetConf{}
+			err = json.Unmarshal([]byte(conf), &n)
+			_, confString, err := buildOneConfig("testConfig", cniVersion, n, prevRes)
+			Expect(err).NotTo(HaveOccurred())
+
+			args.StdinData = confString
+
+			err = testutils.CmdCheckWithArgs(args, func() error {
+				return cmdCheck(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = testutils.CmdDel(originalNS.Path(),
+				args.ContainerID, "", func() error { return cmdDel(args) })
+			Expect(err).NotTo(HaveOccurred())
+
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	Context("CNI 1.1.0", func() {
+		gcConf := func(validAttachments ...types.GCAttachment) []byte {
+			conf := map[string]interface{}{
+				"name":                      "test",
+				"type":                      "vrf",
+				"cniVersion":                "1.1.0",
+				"vrfName":                   VRF0Name,
+				"dataDir":                   testDataDir,
+				"cni.dev/valid-attachments": validAttachments,
+			}
+			res, err := json.Marshal(conf)
+			Expect(err).NotTo(HaveOccurred())
+			return res
+		}
+
+		It("garbage collects the attachments not valid anymore", func() {
+			conf := confVersionFor("1.1.0", "test", IF0Name, VRF0Name, "", "10.0.0.2/24")
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IF0Name,
+				StdinData:   conf,
+			}
+
+			err := originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				r, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(r.Version()).To(Equal("1.1.0"))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Keeping the attachments that are still valid", func() {
+				args := &skel.CmdArgs{
+					StdinData: gcConf(types.GCAttachment{ContainerID: "dummy", IfName: IF0Name}),
+				}
+				Expect(cmdGC(args)).To(Succeed())
+
 				err := targetNS.Do(func(ns.NetNS) error {
 					defer GinkgoRecover()
-
-					l, err := netlink.LinkByName(vrf0)
-					Expect(err).NotTo(HaveOccurred())
-					vrf := l.(*netlink.Vrf)
-					Expect(vrf.Table).To(Equal(uint32(tableid0)))
+					checkInterfaceOnVRF(VRF0Name, IF0Name)
 					return nil
 				})
 				Expect(err).NotTo(HaveOccurred())
 			})
 
-			By("Adding the second interface to second vrf", func() {
-				err := originalNS.Do(func(ns.NetNS) error {
+			By("Removing the attachments that are not valid", func() {
+				args := &skel.CmdArgs{
+					StdinData: gcConf(),
+				}
+				Expect(cmdGC(args)).To(Succeed())
+
+				err := targetNS.Do(func(ns.NetNS) error {
 					defer GinkgoRecover()
-					args := &skel.CmdArgs{
-						ContainerID: "dummy",
-						Netns:       targetNS.Path(),
-						IfName:      IF1Name,
-						StdinData:   conf1,
-					}
-					_, _, err := testutils.CmdAddWithArgs(args, func() error {
-						return cmdAdd(args)
+					checkLinkHasNoMaster(IF0Name)
+					_, err := netlink.LinkByName(VRF0Name)
+					Expect(err).To(HaveOccurred())
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				entries, err := os.ReadDir(filepath.Join(testDataDir, "test"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(entries).To(BeEmpty())
+			})
+		})
+
+		It("reports the plugin as available", func() {
+			args := &skel.CmdArgs{
+				StdinData: gcConf(),
+			}
+			Expect(cmdStatus(args)).To(Succeed())
+		})
+	})
+
+	Context("DEL", func() {
+		var conf []byte
+		var args *skel.CmdArgs
+
+		BeforeEach(func() {
+			conf = confFor("test", IF0Name, VRF0Name, "10.0.0.2/24", "")
+			args = &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IF0Name,
+				StdinData:   conf,
+			}
+		})
+
+		It("succeeds when the vrf does not exist", func() {
+			err := originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				err := testutils.CmdDelWithArgs(args, func() error {
+					return cmdDel(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("succeeds when the netns does not exist", func() {
+			args.Netns = "/var/run/netns/doesnotexist"
+			err := originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				err := testutils.CmdDelWithArgs(args, func() error {
+					return cmdDel(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("is idempotent and removes the vrf when the interface is gone", func() {
+			err := originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				_, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				link, err := netlink.LinkByName(IF0Name)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(netlink.LinkDel(link)).To(Succeed())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				for i := 0; i < 2; i++ {
+					err := testutils.CmdDelWithArgs(args, func() error {
+						return cmdDel(args)
 					})
+					Expect(err).NotTo(HaveOccurred())
+				}
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				_, err := netlink.LinkByName(VRF0Name)
+				Expect(err).To(BeAssignableToTypeOf(netlink.LinkNotFoundError{}))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("does not detach an interface enslaved to another master", func() {
+			err := targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				vrf := &netlink.Vrf{LinkAttrs: netlink.LinkAttrs{Name: VRF1Name}, Table: 1002}
+				Expect(netlink.LinkAdd(vrf)).To(Succeed())
+				link, err := netlink.LinkByName(IF0Name)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(netlink.LinkSetMaster(link, vrf)).To(Succeed())
+
+				vrf0 := &netlink.Vrf{LinkAttrs: netlink.LinkAttrs{Name: VRF0Name}, Table: 1001}
+				Expect(netlink.LinkAdd(vrf0)).To(Succeed())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				err := testutils.CmdDelWithArgs(args, func() error {
+					return cmdDel(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				checkInterfaceOnVRF(VRF1Name, IF0Name)
+				_, err := netlink.LinkByName(VRF0Name)
+				Expect(err).To(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	It("preserves the ipv6 address flags, lifetimes and routes", func() {
+		conf := confWithTableFor("test", IF0Name, VRF0Name, "10.0.0.2/24", 1001, "")
+		withLifetime, err := netlink.ParseAddr("2001:db8::2/64")
+		Expect(err).NotTo(HaveOccurred())
+		withLifetime.ValidLft = 3000
+		withLifetime.PreferedLft = 2000
+		noPrefixRoute, err := netlink.ParseAddr("2001:db8:1::2/64")
+		Expect(err).NotTo(HaveOccurred())
+		noPrefixRoute.Flags = unix.IFA_F_NOPREFIXROUTE
+		_, dst, err := net.ParseCIDR("2001:db8:2::/64")
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			l, err := netlink.LinkByName(IF0Name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(l)).To(Succeed())
+			Expect(netlink.AddrAdd(l, withLifetime)).To(Succeed())
+			Expect(netlink.AddrAdd(l, noPrefixRoute)).To(Succeed())
+			err = netlink.RouteAdd(&netlink.Route{
+				LinkIndex: l.Attrs().Index,
+				Dst:       dst,
+				Gw:        net.ParseIP("2001:db8::1"),
+				Priority:  100,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IF0Name,
+				StdinData:   conf,
+			}
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			l, err := netlink.LinkByName(IF0Name)
+			Expect(err).NotTo(HaveOccurred())
+			addresses, err := netlink.AddrList(l, netlink.FAMILY_V6)
+			Expect(err).NotTo(HaveOccurred())
+
+			found := 0
+			for _, a := range addresses {
+				Expect(a.Flags & unix.IFA_F_TENTATIVE).To(BeZero())
+				switch {
+				case a.Equal(*withLifetime):
+					found++
+					Expect(a.ValidLft).To(BeNumerically("<=", 3000))
+					Expect(a.PreferedLft).To(BeNumerically("<=", 2000))
+				case a.Equal(*noPrefixRoute):
+					found++
+					Expect(a.Flags & unix.IFA_F_NOPREFIXROUTE).NotTo(BeZero())
+				}
+			}
+			Expect(found).To(Equal(2))
+
+			routes, err := netlink.RouteListFiltered(netlink.FAMILY_V6, &netlink.Route{
+				Dst:   dst,
+				Table: 1001,
+			}, netlink.RT_FILTER_DST|netlink.RT_FILTER_TABLE)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes).To(HaveLen(1))
+			Expect(routes[0].Gw.String()).To(Equal("2001:db8::1"))
+			Expect(routes[0].Priority).To(Equal(100))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
 
-					if expectedError != "" {
-						Expect(err).To(HaveOccurred())
-						Expect(err.Error()).To(ContainSubstring(expectedError))
-					} else {
-						Expect(err).NotTo(HaveOccurred())
-					}
-					return nil
-				})
-				Expect(err).NotTo(HaveOccurred())
-			})
-		},
-		Entry("same vrf with same tableid", VRF0Name, VRF0Name, 1001, 1001, ""),
-		Entry("same vrf with different tableids", VRF0Name, VRF0Name, 1001, 1002, "already exist with different routing table"),
-		Entry("different vrf with same tableid", VRF0Name, VRF1Name, 1001, 1001, "already used by"),
-	)
+	Context("waiting for DAD", func() {
+		const (
+			vethName = "veth0"
+			peerName = "veth0peer"
+		)
+		var args *skel.CmdArgs
+		var ipv6 *netlink.Addr
+
+		BeforeEach(func() {
+			var err error
+			ipv6, err = netlink.ParseAddr("2001:db8::2/64")
+			Expect(err).NotTo(HaveOccurred())
 
-	It("removes the VRF only when the last interface is removed", func() {
-		conf0 := confFor("test", IF0Name, VRF0Name, "10.0.0.2/24")
-		conf1 := confFor("test1", IF1Name, VRF0Name, "10.0.0.2/24")
+			conf := confVersionFor("1.0.0", "test", vethName, VRF0Name, `"waitDAD": true, "dadTimeout": "5s",`)
+			args = &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      vethName,
+				StdinData:   conf,
+			}
 
-		By("Adding the two interfaces to the VRF", func() {
-			err := originalNS.Do(func(ns.NetNS) error {
+			err = targetNS.Do(func(ns.NetNS) error {
 				defer GinkgoRecover()
-				args := &skel.CmdArgs{
-					ContainerID: "dummy",
-					Netns:       targetNS.Path(),
-					IfName:      IF0Name,
-					StdinData:   conf0,
-				}
-				_, _, err := testutils.CmdAddWithArgs(args, func() error {
-					return cmdAdd(args)
+				err := netlink.LinkAdd(&netlink.Veth{
+					LinkAttrs: netlink.LinkAttrs{Name: vethName},
+					PeerName:  peerName,
 				})
 				Expect(err).NotTo(HaveOccurred())
+				peer, err := netlink.LinkByName(peerName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(netlink.LinkSetNsFd(peer, int(originalNS.Fd()))).To(Succeed())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
 
-				args = &skel.CmdArgs{
-					ContainerID: "dummy",
-					Netns:       targetNS.Path(),
-					IfName:      IF1Name,
-					StdinData:   conf1,
-				}
-				_, _, err = testutils.CmdAddWithArgs(args, func() error {
-					return cmdAdd(args)
-				})
+			err = originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				peer, err := netlink.LinkByName(peerName)
 				Expect(err).NotTo(HaveOccurred())
+				Expect(netlink.LinkSetUp(peer)).To(Succeed())
 				return nil
 			})
 			Expect(err).NotTo(HaveOccurred())
 		})
 
-		By("Checking that the two interfaces are added to the VRF", func() {
-			targetNS.Do(func(ns.NetNS) error {
+		addAddress := func() {
+			err := targetNS.Do(func(ns.NetNS) error {
 				defer GinkgoRecover()
-				checkInterfaceOnVRF(VRF0Name, IF0Name)
-				checkInterfaceOnVRF(VRF0Name, IF1Name)
+				l, err := netlink.LinkByName(vethName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(netlink.LinkSetUp(l)).To(Succeed())
+				Expect(netlink.AddrAdd(l, ipv6)).To(Succeed())
 				return nil
 			})
-		})
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		It("returns once the addresses are not tentative anymore", func() {
+			addAddress()
 
-		By("Removing the first interface from VRF, removing the interface", func() {
 			err := originalNS.Do(func(ns.NetNS) error {
 				defer GinkgoRecover()
-				args := &skel.CmdArgs{
-					ContainerID: "dummy",
-					Netns:       targetNS.Path(),
-					IfName:      IF0Name,
-					StdinData:   conf0,
-				}
-				err := testutils.CmdDelWithArgs(args, func() error {
-					return cmdDel(args)
+				_, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
 				})
 				Expect(err).NotTo(HaveOccurred())
 				return nil
@@ -465,185 +1768,320 @@ var _ = Describe("vrf plugin", func() {
 			Expect(err).NotTo(HaveOccurred())
 
 			err = targetNS.Do(func(ns.NetNS) error {
-				link, err := netlink.LinkByName(IF0Name)
+				defer GinkgoRecover()
+				l, err := netlink.LinkByName(vethName)
 				Expect(err).NotTo(HaveOccurred())
-				err = netlink.LinkDel(link)
+				addresses, err := netlink.AddrList(l, netlink.FAMILY_V6)
 				Expect(err).NotTo(HaveOccurred())
+				for _, a := range addresses {
+					Expect(a.Flags & unix.IFA_F_TENTATIVE).To(BeZero())
+				}
 				return nil
 			})
 			Expect(err).NotTo(HaveOccurred())
 		})
 
-		By("Checking that the second interface is still on the VRF and that VRF still exists", func() {
-			targetNS.Do(func(ns.NetNS) error {
+		It("fails naming the duplicate address", func() {
+			err := originalNS.Do(func(ns.NetNS) error {
 				defer GinkgoRecover()
-				checkInterfaceOnVRF(VRF0Name, IF1Name)
+				peer, err := netlink.LinkByName(peerName)
+				Expect(err).NotTo(HaveOccurred())
+				duplicate := *ipv6
+				duplicate.Flags = unix.IFA_F_NODAD
+				Expect(netlink.AddrAdd(peer, &duplicate)).To(Succeed())
 				return nil
 			})
-		})
+			Expect(err).NotTo(HaveOccurred())
 
-		By("Removing the second interface from VRF, deleting the second interface", func() {
-			err := originalNS.Do(func(ns.NetNS) error {
+			addAddress()
+
+			err = originalNS.Do(func(ns.NetNS) error {
 				defer GinkgoRecover()
-				args := &skel.CmdArgs{
-					ContainerID: "dummy",
-					Netns:       targetNS.Path(),
-					IfName:      IF1Name,
-					StdinData:   conf1,
-				}
-				err := testutils.CmdDelWithArgs(args, func() error {
-					return cmdDel(args)
+				_, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
 				})
-				Expect(err).NotTo(HaveOccurred())
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("duplicate address 2001:db8::2/64"))
 				return nil
 			})
 			Expect(err).NotTo(HaveOccurred())
+		})
+	})
 
-			err = targetNS.Do(func(ns.NetNS) error {
-				link, err := netlink.LinkByName(IF1Name)
-				Expect(err).NotTo(HaveOccurred())
-				err = netlink.LinkDel(link)
-				Expect(err).NotTo(HaveOccurred())
-				return nil
+	It("announces the addresses of the interface", func() {
+		const (
+			vethName = "veth0"
+			peerName = "veth0peer"
+		)
+		conf := confVersionFor("1.0.0", "test", vethName, VRF0Name, `"announceAddresses": true,`, "10.0.0.2/24", "2001:db8::2/64")
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      vethName,
+			StdinData:   conf,
+		}
+
+		var mac net.HardwareAddr
+		err := targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			err := netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: vethName},
+				PeerName:  peerName,
 			})
 			Expect(err).NotTo(HaveOccurred())
+			l, err := netlink.LinkByName(vethName)
+			Expect(err).NotTo(HaveOccurred())
+			mac = l.Attrs().HardwareAddr
+			for _, a := range []string{"10.0.0.2/24", "2001:db8::2/64"} {
+				addr, err := netlink.ParseAddr(a)
+				Expect(err).NotTo(HaveOccurred())
+				addr.Flags = unix.IFA_F_NODAD
+				Expect(netlink.AddrAdd(l, addr)).To(Succeed())
+			}
+			Expect(netlink.LinkSetUp(l)).To(Succeed())
+			peer, err := netlink.LinkByName(peerName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetNsFd(peer, int(originalNS.Fd()))).To(Succeed())
+			return nil
 		})
+		Expect(err).NotTo(HaveOccurred())
 
-		By("Checking that the VRF is removed", func() {
-			targetNS.Do(func(ns.NetNS) error {
-				defer GinkgoRecover()
-				_, err := netlink.LinkByName(VRF0Name)
-				Expect(err).NotTo(BeNil())
-				return nil
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			peer, err := netlink.LinkByName(peerName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(peer)).To(Succeed())
+			// A stale entry, that the gratuitous arp is expected to update.
+			err = netlink.NeighAdd(&netlink.Neigh{
+				LinkIndex:    peer.Attrs().Index,
+				Family:       netlink.FAMILY_V4,
+				State:        netlink.NUD_STALE,
+				IP:           net.ParseIP("10.0.0.2"),
+				HardwareAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, err = testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
 			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Eventually(func() (net.HardwareAddr, error) {
+				neighs, err := netlink.NeighList(peer.Attrs().Index, netlink.FAMILY_V4)
+				if err != nil {
+					return nil, err
+				}
+				for _, n := range neighs {
+					if n.IP.Equal(net.ParseIP("10.0.0.2")) {
+						return n.HardwareAddr, nil
+					}
+				}
+				return nil, nil
+			}).Should(Equal(mac))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			checkInterfaceOnVRF(VRF0Name, vethName)
+			return nil
 		})
+		Expect(err).NotTo(HaveOccurred())
 	})
 
-	It("configures and deconfigures mtu with CNI 0.4.0 ADD/DEL", func() {
-		conf := []byte(fmt.Sprintf(`{
-	"name": "test",
-	"type": "vrf",
-	"cniVersion": "0.4.0",
-	"vrfName": "%s",
-	"prevResult": {
-		"interfaces": [
-			{"name": "%s", "sandbox":"netns"}
-		],
-		"ips": [
-			{
-				"version": "4",
-				"address": "10.0.0.2/24",
-				"gateway": "10.0.0.1",
-				"interface": 0
-			}
-		]
-	}
-}`, VRF0Name, IF0Name))
+	It("logs the netlink actions at debug level", func() {
+		logDir, err := os.MkdirTemp("", "vrf-cni")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(logDir)
+		logFile := filepath.Join(logDir, "vrf.log")
 
+		extra := fmt.Sprintf(`"logFile": %q, "logLevel": "debug",`, logFile)
+		conf := confVersionFor("1.0.0", "test", IF0Name, VRF0Name, extra)
 		args := &skel.CmdArgs{
 			ContainerID: "dummy",
 			Netns:       targetNS.Path(),
 			IfName:      IF0Name,
 			StdinData:   conf,
 		}
-		var prevRes types.Result
-		err := originalNS.Do(func(ns.NetNS) error {
-			defer GinkgoRecover()
 
-			prevRes, _, err := testutils.CmdAddWithArgs(args, func() error {
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
 				return cmdAdd(args)
 			})
 			Expect(err).NotTo(HaveOccurred())
-
-			result, err := current.GetResult(prevRes)
+			err = testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
 			Expect(err).NotTo(HaveOccurred())
-
-			Expect(len(result.Interfaces)).To(Equal(1))
-			Expect(result.Interfaces[0].Name).To(Equal(IF0Name))
-			Expect(len(result.IPs)).To(Equal(1))
-			Expect(result.IPs[0].Address.String()).To(Equal("10.0.0.2/24"))
 			return nil
 		})
 		Expect(err).NotTo(HaveOccurred())
 
+		data, err := os.ReadFile(logFile)
+		Expect(err).NotTo(HaveOccurred())
+		log := string(data)
+		Expect(log).To(ContainSubstring(fmt.Sprintf("containerID=dummy ifName=%s netns=%s", IF0Name, targetNS.Path())))
+		Expect(log).To(ContainSubstring("AllocateTable: allocated table"))
+		Expect(log).To(ContainSubstring("Ensure: adding vrf " + VRF0Name))
+		Expect(log).To(ContainSubstring("Attach: setting vrf " + VRF0Name + " as master of " + IF0Name))
+		Expect(log).To(ContainSubstring("Detach: removing " + IF0Name + " from vrf " + VRF0Name))
+		Expect(log).To(ContainSubstring("[info] "))
+		Expect(log).To(ContainSubstring("ADD succeeded"))
+		Expect(log).To(ContainSubstring("DEL succeeded"))
+	})
+
+	It("keeps the ipv6 addresses of the interface on DEL", func() {
+		conf := confFor("test", IF0Name, VRF0Name, "10.0.0.2/24", "")
+		ipv6, err := netlink.ParseAddr("2001:db8::2/64")
+		Expect(err).NotTo(HaveOccurred())
+
 		err = targetNS.Do(func(ns.NetNS) error {
 			defer GinkgoRecover()
-			checkInterfaceOnVRF(VRF0Name, IF0Name)
+			l, err := netlink.LinkByName(IF0Name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(l, ipv6)).To(Succeed())
+			Expect(netlink.LinkSetUp(l)).To(Succeed())
 			return nil
 		})
+		Expect(err).NotTo(HaveOccurred())
 
 		err = originalNS.Do(func(ns.NetNS) error {
 			defer GinkgoRecover()
-			cniVersion := "0.4.0"
-			n := &VRFNetConf{}
-			err = json.Unmarshal([]byte(conf), &n)
-			_, confString, err := buildOneConfig("testConfig", cniVersion, n, prevRes)
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IF0Name,
+				StdinData:   conf,
+			}
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
 			Expect(err).NotTo(HaveOccurred())
 
-			args.StdinData = confString
-
-			err = testutils.CmdCheckWithArgs(args, func() error {
-				return cmdCheck(args)
+			err = testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
 			})
 			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
 
-			err = testutils.CmdDel(originalNS.Path(),
-				args.ContainerID, "", func() error { return cmdDel(args) })
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			checkLinkHasNoMaster(IF0Name)
+			l, err := netlink.LinkByName(IF0Name)
 			Expect(err).NotTo(HaveOccurred())
-
+			addresses, err := netlink.AddrList(l, netlink.FAMILY_V6)
+			Expect(err).NotTo(HaveOccurred())
+			found := false
+			for _, a := range addresses {
+				if a.Equal(*ipv6) {
+					found = true
+				}
+			}
+			Expect(found).To(BeTrue())
 			return nil
 		})
 		Expect(err).NotTo(HaveOccurred())
 	})
 
-})
+	DescribeTable("reports drift on CHECK",
+		func(drift func(), expectedError string) {
+			conf := confWithTableFor("test", IF0Name, VRF0Name, "10.0.0.2/24", 1001, "")
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IF0Name,
+				StdinData:   conf,
+			}
 
-func confFor(name, intf, vrf, ip string) []byte {
-	conf := fmt.Sprintf(`{
-		"name": "%s",
-		"type": "vrf",
-		"cniVersion": "0.3.1",
-		"vrfName": "%s",
-		"prevResult": {
-			"interfaces": [
-				{"name": "%s", "sandbox":"netns"}
-			],
-			"ips": [
-				{
-					"version": "4",
-					"address": "%s",
-					"gateway": "10.0.0.1",
-					"interface": 0
-				}
-			]
-		}
-	}`, name, vrf, intf, ip)
-	return []byte(conf)
-}
+			By("Setting the interface's ip", func() {
+				err := targetNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+					l, err := netlink.LinkByName(IF0Name)
+					Expect(err).NotTo(HaveOccurred())
+					addr, err := netlink.ParseAddr("10.0.0.2/24")
+					Expect(err).NotTo(HaveOccurred())
+					err = netlink.AddrAdd(l, addr)
+					Expect(err).NotTo(HaveOccurred())
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
 
-func confWithTableFor(name, intf, vrf, ip string, tableID int) []byte {
-	conf := fmt.Sprintf(`{
-		"name": "%s",
-		"type": "vrf",
-		"cniVersion": "0.3.1",
-		"vrfName": "%s",
-		"table": %d,
-		"prevResult": {
-			"interfaces": [
-				{"name": "%s", "sandbox":"netns"}
-			],
-			"ips": [
-				{
-					"version": "4",
-					"address": "%s",
-					"gateway": "10.0.0.1",
-					"interface": 0
-				}
-			]
-		}
-	}`, name, vrf, tableID, intf, ip)
-	return []byte(conf)
-}
+			By("Adding the interface to the vrf", func() {
+				err := originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+					_, _, err := testutils.CmdAddWithArgs(args, func() error {
+						return cmdAdd(args)
+					})
+					Expect(err).NotTo(HaveOccurred())
+
+					err = testutils.CmdCheckWithArgs(args, func() error {
+						return cmdCheck(args)
+					})
+					Expect(err).NotTo(HaveOccurred())
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			By("Introducing the drift", func() {
+				err := targetNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+					drift()
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			By("Checking that CHECK fails", func() {
+				err := originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+					err := testutils.CmdCheckWithArgs(args, func() error {
+						return cmdCheck(args)
+					})
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring(expectedError))
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+		},
+		Entry("when the vrf is removed", func() {
+			l, err := netlink.LinkByName(VRF0Name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkDel(l)).To(Succeed())
+		}, "VRF vrf0 not found"),
+		Entry("when the vrf is down", func() {
+			l, err := netlink.LinkByName(VRF0Name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetDown(l)).To(Succeed())
+		}, "VRF vrf0 is down"),
+		Entry("when the vrf has a different table", func() {
+			l, err := netlink.LinkByName(VRF0Name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkDel(l)).To(Succeed())
+			vrf := &netlink.Vrf{LinkAttrs: netlink.LinkAttrs{Name: VRF0Name}, Table: 1002}
+			Expect(netlink.LinkAdd(vrf)).To(Succeed())
+			Expect(netlink.LinkSetUp(vrf)).To(Succeed())
+		}, "has routing table 1002, expected 1001"),
+		Entry("when the interface is removed from the vrf", func() {
+			l, err := netlink.LinkByName(IF0Name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetNoMaster(l)).To(Succeed())
+		}, "interface dummy0 is not enslaved to VRF vrf0"),
+		Entry("when the address is removed from the interface", func() {
+			l, err := netlink.LinkByName(IF0Name)
+			Expect(err).NotTo(HaveOccurred())
+			addr, err := netlink.ParseAddr("10.0.0.2/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrDel(l, addr)).To(Succeed())
+		}, "address 10.0.0.2/24 not found on interface dummy0"),
+	)
+})
 
 func checkInterfaceOnVRF(vrfName, intfName string) {
 	vrf, err := netlink.LinkByName(vrfName)